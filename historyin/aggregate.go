@@ -0,0 +1,212 @@
+package historyin
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/internal/kpl"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	// aggregateKeysMaxBytes is the most bytes the partition key and explicit
+	// hash key of an aggregated record add to the records it packs
+	aggregateKeysMaxBytes = 256 + 39
+
+	// how long listed shards are used before listing them again
+	aggregateShardsMaxAge = time.Minute
+)
+
+// aggregatingTransport packs records into KPL aggregated records before
+// sending them through Transport. Like the KPL, records are grouped by the
+// shard their hash key falls in, so records of any partition key can share an
+// aggregated record while every record of a partition key lands on the same
+// shard in order. Records are grouped by hash key instead if Transport cannot
+// list its shards.
+type aggregatingTransport struct {
+	Transport Transport
+	Logger    LeveledLogger
+
+	shardsLock sync.Mutex
+	shardList  []shardRange
+	listedAt   time.Time
+}
+
+// Put implements Transport. Single records are not aggregated.
+func (t *aggregatingTransport) Put(ctx context.Context, record *Record) error {
+	return t.Transport.Put(ctx, record)
+}
+
+// Limits leaves room in batches for aggregation overhead
+func (t *aggregatingTransport) Limits() TransportLimits {
+	limits := transportLimits(t.Transport)
+	limits.MaxBatchBytes -= kpl.Overhead(limits.MaxBatchRecords) + limits.MaxBatchRecords*aggregateKeysMaxBytes
+	limits.MaxRecordBytes -= kpl.Overhead(1) + aggregateKeysMaxBytes
+	return limits
+}
+
+// PutBatch implements Transport. Each record's result is the result of the
+// aggregated record it was packed in.
+func (t *aggregatingTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	aggregated, packed := t.aggregate(records, transportLimits(t.Transport).MaxRecordBytes, t.shards(ctx))
+
+	aggregatedResults, err := t.Transport.PutBatch(ctx, aggregated)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(aggregatedResults) != len(aggregated) {
+		return nil, errInvalidPutBatchResponse
+	}
+
+	results := make([]*RecordResult, len(records))
+	for nAggregate, result := range aggregatedResults {
+		for _, nRecord := range packed[nAggregate] {
+			results[nRecord] = result
+		}
+	}
+
+	return results, nil
+}
+
+// shards returns the shards of Transport sorted by hash key, listing them
+// again once they are older than aggregateShardsMaxAge. It returns nil if
+// they are unknown.
+func (t *aggregatingTransport) shards(ctx context.Context) []shardRange {
+	lister, ok := t.Transport.(shardLister)
+	if !ok {
+		return nil
+	}
+
+	t.shardsLock.Lock()
+	defer t.shardsLock.Unlock()
+
+	if !t.listedAt.IsZero() && time.Since(t.listedAt) < aggregateShardsMaxAge {
+		return t.shardList
+	}
+	t.listedAt = time.Now()
+
+	shards, err := lister.shards(ctx)
+	if err != nil {
+		if t.Logger != nil {
+			t.Logger.Warn("error listing shards to aggregate records",
+				"stream", transportStreamName(t.Transport),
+				"error", err)
+		}
+		return t.shardList
+	}
+
+	sort.Slice(shards, func(i, j int) bool { return shards[i].start.Cmp(shards[j].start) < 0 })
+	t.shardList = shards
+	return shards
+}
+
+// aggregate packs records into aggregated records of at most maxBytes,
+// returning the indexes of the records packed in each. Records are grouped by
+// the shard their hash key falls in, or by hash key if it is in none of
+// shards.
+func (t *aggregatingTransport) aggregate(records []*Record, maxBytes int, shards []shardRange) ([]*Record, [][]int) {
+	var groups []*aggregateGroup
+	groupsByKey := make(map[string]*aggregateGroup)
+	for nRecord, record := range records {
+		hashKey := record.ExplicitHashKey
+		if hashKey == "" {
+			hashKey = kpl.ExplicitHashKey(record.PartitionKey)
+		}
+
+		groupKey := hashKey
+		if shard, ok := findShard(shards, hashKey); ok {
+			groupKey = shard.id
+		}
+
+		group, ok := groupsByKey[groupKey]
+		if !ok || group.size+record.size()+kpl.Overhead(len(group.records)+1)+aggregateKeysMaxBytes > maxBytes {
+			group = &aggregateGroup{hashKey: hashKey}
+			groupsByKey[groupKey] = group
+			groups = append(groups, group)
+		}
+		group.add(nRecord, record)
+	}
+
+	aggregated := make([]*Record, 0, len(groups))
+	packed := make([][]int, 0, len(groups))
+	for _, group := range groups {
+		aggregated = append(aggregated, group.record())
+		packed = append(packed, group.indexes)
+	}
+
+	return aggregated, packed
+}
+
+// shardRange is the range of hash keys of a shard
+type shardRange struct {
+	id         string
+	start, end *big.Int
+}
+
+func newShardRange(shard *kinesis.Shard) (shardRange, error) {
+	r := shardRange{id: aws.StringValue(shard.ShardId)}
+	if shard.HashKeyRange == nil {
+		return r, fmt.Errorf("shard %s has no hash key range", r.id)
+	}
+
+	var ok bool
+	if r.start, ok = new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.StartingHashKey), 10); !ok {
+		return r, fmt.Errorf("shard %s has an invalid starting hash key", r.id)
+	}
+	if r.end, ok = new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.EndingHashKey), 10); !ok {
+		return r, fmt.Errorf("shard %s has an invalid ending hash key", r.id)
+	}
+	return r, nil
+}
+
+// findShard returns the shard whose range contains hashKey. shards must be
+// sorted by hash key.
+func findShard(shards []shardRange, hashKey string) (shardRange, bool) {
+	if len(shards) == 0 {
+		return shardRange{}, false
+	}
+
+	key, ok := new(big.Int).SetString(hashKey, 10)
+	if !ok {
+		return shardRange{}, false
+	}
+
+	i := sort.Search(len(shards), func(i int) bool { return shards[i].end.Cmp(key) >= 0 })
+	if i == len(shards) || shards[i].start.Cmp(key) > 0 {
+		return shardRange{}, false
+	}
+	return shards[i], true
+}
+
+// aggregateGroup is the records packed in a single aggregated record. Its
+// hash key is that of its first record, which routes it to their shard.
+type aggregateGroup struct {
+	hashKey string
+	size    int
+	indexes []int
+	records []*kpl.Record
+}
+
+func (g *aggregateGroup) add(nRecord int, record *Record) {
+	g.indexes = append(g.indexes, nRecord)
+	g.size += record.size()
+	g.records = append(g.records, &kpl.Record{
+		PartitionKey:    record.PartitionKey,
+		ExplicitHashKey: record.ExplicitHashKey,
+		Data:            record.Data,
+	})
+}
+
+func (g *aggregateGroup) record() *Record {
+	return &Record{
+		PartitionKey:    g.records[0].PartitionKey,
+		ExplicitHashKey: g.hashKey,
+		Data:            kpl.Marshal(g.records),
+	}
+}
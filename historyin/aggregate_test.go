@@ -0,0 +1,239 @@
+package historyin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"code.justin.tv/foundation/history.v2/internal/kpl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTransport records batches and fails records with a partition key
+// in failKeys
+type recordingTransport struct {
+	batches  [][]*Record
+	failKeys map[string]bool
+	err      error
+}
+
+func (t *recordingTransport) Put(ctx context.Context, record *Record) error {
+	t.batches = append(t.batches, []*Record{record})
+	return t.err
+}
+
+func (t *recordingTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	t.batches = append(t.batches, records)
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	results := make([]*RecordResult, 0, len(records))
+	for _, record := range records {
+		result := &RecordResult{}
+		if t.failKeys[record.PartitionKey] {
+			result.ErrorCode = "InternalFailure"
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// shardedTransport is a recordingTransport with shards
+type shardedTransport struct {
+	*recordingTransport
+	shardList []shardRange
+	err       error
+}
+
+func (t *shardedTransport) shards(ctx context.Context) ([]shardRange, error) {
+	return t.shardList, t.err
+}
+
+// testShards splits the hash key space evenly into n shards
+func testShards(n int64) []shardRange {
+	max := new(big.Int).Lsh(big.NewInt(1), 128)
+	width := new(big.Int).Div(max, big.NewInt(n))
+
+	shards := make([]shardRange, n)
+	for i := range shards {
+		start := new(big.Int).Mul(width, big.NewInt(int64(i)))
+		end := new(big.Int).Add(start, width)
+		if i == len(shards)-1 {
+			end = max
+		}
+		shards[i] = shardRange{
+			id:    fmt.Sprintf("shardId-%012d", i),
+			start: start,
+			end:   end.Sub(end, big.NewInt(1)),
+		}
+	}
+	return shards
+}
+
+func TestAggregatingTransport(t *testing.T) {
+	t.Run("packs records by shard", func(t *testing.T) {
+		b := batch{}
+		for i := 0; i < 100; i++ {
+			audit := testAudit()
+			audit.ResourceID = fmt.Sprint(i)
+			require.NoError(t, b.Add(audit))
+		}
+		records := b.PopBatch(100, kinesisBatchMaxBytes)
+		require.Len(t, records, 100)
+
+		shards := testShards(2)
+		inner := &recordingTransport{}
+		transport := &aggregatingTransport{Transport: &shardedTransport{recordingTransport: inner, shardList: shards}}
+		results, err := transport.PutBatch(context.Background(), records)
+		require.NoError(t, err)
+		assert.Len(t, results, len(records))
+
+		require.Len(t, inner.batches, 1)
+		aggregated := inner.batches[0]
+		assert.Len(t, aggregated, len(shards), "default keys should be packed per shard")
+
+		var nPacked int
+		for _, record := range aggregated {
+			shard, ok := findShard(shards, record.ExplicitHashKey)
+			require.True(t, ok)
+
+			packed, err := kpl.Unmarshal(record.Data)
+			require.NoError(t, err)
+			for _, p := range packed {
+				packedShard, ok := findShard(shards, kpl.ExplicitHashKey(p.PartitionKey))
+				require.True(t, ok)
+				assert.Equal(t, shard.id, packedShard.id, "records should be packed with their shard")
+			}
+			nPacked += len(packed)
+		}
+		assert.Equal(t, len(records), nPacked)
+	})
+
+	t.Run("groups by hash key if shards cannot be listed", func(t *testing.T) {
+		inner := &recordingTransport{}
+		transport := &aggregatingTransport{
+			Transport: &shardedTransport{recordingTransport: inner, err: errors.New("access denied")},
+			Logger:    nopLogger{},
+		}
+
+		_, err := transport.PutBatch(context.Background(), []*Record{
+			{PartitionKey: "key-a"},
+			{PartitionKey: "key-b"},
+			{PartitionKey: "key-a"},
+		})
+		require.NoError(t, err)
+		require.Len(t, inner.batches, 1)
+		assert.Len(t, inner.batches[0], 2)
+	})
+
+	t.Run("findShard", func(t *testing.T) {
+		shards := testShards(4)
+		for _, tc := range []struct {
+			hashKey string
+			shard   int
+		}{
+			{"0", 0},
+			{shards[1].start.String(), 1},
+			{shards[1].end.String(), 1},
+			{"340282366920938463463374607431768211455", 3},
+		} {
+			shard, ok := findShard(shards, tc.hashKey)
+			require.True(t, ok, tc.hashKey)
+			assert.Equal(t, shards[tc.shard].id, shard.id, tc.hashKey)
+		}
+
+		_, ok := findShard(shards, "340282366920938463463374607431768211456")
+		assert.False(t, ok, "keys past the last shard are in none")
+		_, ok = findShard(nil, "0")
+		assert.False(t, ok)
+	})
+
+	t.Run("groups by explicit hash key in order", func(t *testing.T) {
+		inner := &recordingTransport{failKeys: map[string]bool{"key-b": true}}
+		transport := &aggregatingTransport{Transport: inner}
+
+		records := []*Record{
+			{PartitionKey: "key-a", Data: []byte("1")},
+			{PartitionKey: "key-b", Data: []byte("2")},
+			{PartitionKey: "key-a", Data: []byte("3")},
+			{PartitionKey: "key-c", ExplicitHashKey: "42", Data: []byte("4")},
+			{PartitionKey: "key-d", ExplicitHashKey: "42", Data: []byte("5")},
+		}
+		results, err := transport.PutBatch(context.Background(), records)
+		require.NoError(t, err)
+
+		require.Len(t, inner.batches, 1)
+		aggregated := inner.batches[0]
+		require.Len(t, aggregated, 3)
+
+		for nAggregate, expected := range []struct {
+			PartitionKey    string
+			ExplicitHashKey string
+			Records         []*Record
+		}{
+			{"key-a", kpl.ExplicitHashKey("key-a"), []*Record{records[0], records[2]}},
+			{"key-b", kpl.ExplicitHashKey("key-b"), []*Record{records[1]}},
+			{"key-c", "42", []*Record{records[3], records[4]}},
+		} {
+			assert.Equal(t, expected.PartitionKey, aggregated[nAggregate].PartitionKey)
+			assert.Equal(t, expected.ExplicitHashKey, aggregated[nAggregate].ExplicitHashKey)
+
+			packed, err := kpl.Unmarshal(aggregated[nAggregate].Data)
+			require.NoError(t, err)
+			require.Len(t, packed, len(expected.Records))
+			for nRecord, record := range expected.Records {
+				assert.Equal(t, record.PartitionKey, packed[nRecord].PartitionKey)
+				assert.Equal(t, record.ExplicitHashKey, packed[nRecord].ExplicitHashKey)
+				assert.Equal(t, record.Data, packed[nRecord].Data)
+			}
+		}
+
+		require.Len(t, results, len(records))
+		for nRecord, failed := range []bool{false, true, false, false, false} {
+			assert.Equal(t, failed, results[nRecord].Failed(), "record %d", nRecord)
+		}
+	})
+
+	t.Run("splits aggregates over the max record size", func(t *testing.T) {
+		inner := &recordingTransport{}
+		transport := &aggregatingTransport{Transport: inner}
+
+		data := []byte(strings.Repeat("a", kinesisRecordMaxBytes/2))
+		records := []*Record{
+			{PartitionKey: "key-a", Data: data},
+			{PartitionKey: "key-a", Data: data},
+		}
+		_, err := transport.PutBatch(context.Background(), records)
+		require.NoError(t, err)
+
+		require.Len(t, inner.batches, 1)
+		require.Len(t, inner.batches[0], 2)
+		for _, aggregated := range inner.batches[0] {
+			assert.True(t, aggregated.size() <= kinesisRecordMaxBytes)
+		}
+	})
+
+	t.Run("aggregates of limited batches fit the transport", func(t *testing.T) {
+		limits := (&aggregatingTransport{Transport: &KinesisTransport{}}).Limits()
+		data := []byte(strings.Repeat("a", limits.MaxRecordBytes-len("key-a")))
+
+		aggregated, _ := (&aggregatingTransport{}).aggregate([]*Record{
+			{PartitionKey: "key-a", Data: data},
+		}, kinesisRecordMaxBytes, nil)
+		require.Len(t, aggregated, 1)
+		assert.True(t, aggregated[0].size() <= kinesisRecordMaxBytes)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		myErr := errors.New("my-error")
+		transport := &aggregatingTransport{Transport: &recordingTransport{err: myErr}}
+
+		_, err := transport.PutBatch(context.Background(), []*Record{{PartitionKey: "key-a"}})
+		assert.Equal(t, myErr, err)
+	})
+}
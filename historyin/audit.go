@@ -31,6 +31,11 @@ type Audit struct {
 	UUID      UUID
 	CreatedAt Time
 	TTL       Duration
+
+	// TraceID and SpanID identify the request that produced the audit. They
+	// are filled from the context by clients with CaptureTrace set.
+	TraceID string
+	SpanID  string
 }
 
 // ExpiredAt returns the time when audit will be expired
@@ -40,7 +45,22 @@ func (a *Audit) ExpiredAt() Time {
 
 // MarshalJSON implements json.Marshaller
 func (a *Audit) MarshalJSON() ([]byte, error) {
-	return json.Marshal(audit{
+	return json.Marshal(a.toJSON())
+}
+
+// UnmarshalJSON implements json.Unmarshaller. Both bare audits and audits in
+// an Envelope, as records are written, are read.
+func (a *Audit) UnmarshalJSON(data []byte) error {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	*a = *e.Audit
+	return nil
+}
+
+func (a *Audit) toJSON() audit {
+	return audit{
 		UUID:         a.UUID,
 		Action:       a.Action,
 		UserType:     a.UserType,
@@ -52,16 +72,12 @@ func (a *Audit) MarshalJSON() ([]byte, error) {
 		ExpiredAt:    a.ExpiredAt(),
 		Expiry:       a.TTL,
 		Changes:      a.Changes,
-	})
-}
-
-// UnmarshalJSON implements json.Unmarshaller
-func (a *Audit) UnmarshalJSON(data []byte) error {
-	var raw audit
-	if err := json.Unmarshal(data, &raw); err != nil {
-		return err
+		TraceID:      a.TraceID,
+		SpanID:       a.SpanID,
 	}
+}
 
+func (a *Audit) fromJSON(raw audit) {
 	a.UUID = raw.UUID
 	a.Action = raw.Action
 	a.UserType = raw.UserType
@@ -72,8 +88,8 @@ func (a *Audit) UnmarshalJSON(data []byte) error {
 	a.CreatedAt = raw.CreatedAt
 	a.TTL = raw.Expiry
 	a.Changes = raw.Changes
-
-	return nil
+	a.TraceID = raw.TraceID
+	a.SpanID = raw.SpanID
 }
 
 // fillOptional fills fields that are marked as optional if not set
@@ -143,6 +159,8 @@ type audit struct {
 	ExpiredAt    Time        `json:"expired_at,omitempty"`
 	Expiry       Duration    `json:"expiry,omitempty"`
 	Changes      []ChangeSet `json:"changes"`
+	TraceID      string      `json:"trace_id,omitempty"`
+	SpanID       string      `json:"span_id,omitempty"`
 }
 
 // ChangeSet is a change of an attribute
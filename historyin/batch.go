@@ -1,19 +1,76 @@
 package historyin
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"sync"
+)
+
+// OverflowPolicy is what a batcher does with audits added when its queue is
+// full
+type OverflowPolicy int
 
-	"code.justin.tv/foundation/history.v2/internal/batch/processoriface"
+// OverflowPolicies of Client
+const (
+	// OverflowBlock blocks Add until there is room in the queue, returning
+	// ErrBatcherStopped if the batcher stops first
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the audit being added, returning ErrQueueFull
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued audits to make room
+	OverflowDropOldest
+)
+
+var (
+	// ErrQueueFull is returned when an audit is dropped by OverflowDropNewest
+	ErrQueueFull = errors.New("batcher queue is full")
+	// ErrBatcherStopped is returned when an audit is added to or waited on in
+	// a batcher that has stopped
+	ErrBatcherStopped = errors.New("batcher has been stopped")
 )
 
 // batch batches audits to send to kinesis
 type batch struct {
+	// Name identifies the batch in metrics
+	Name string
+	// Threshold is the number of queued records that triggers a batch
 	Threshold int
+	// ThresholdBytes, if set, is the size of queued records that triggers a
+	// batch
+	ThresholdBytes int
+	// MaxRecordBytes is the max size of a record. Defaults to the kinesis limit.
+	MaxRecordBytes int
+
+	// MaxQueueRecords and MaxQueueBytes bound the records waiting to be sent.
+	// Zero is unbounded. A record is always queued if the queue is empty.
+	MaxQueueRecords int
+	MaxQueueBytes   int
+	// Overflow is what Add does when the queue is full
+	Overflow OverflowPolicy
+
+	// PartitionKey keys records. Defaults to PartitionByUUID.
+	PartitionKey PartitionKeyFunc
+	// ServiceName is the producer of records. Defaults to the executable.
+	ServiceName string
+
+	// Spool, if set, durably stores records until they are acknowledged
+	Spool *spool
+
+	Metrics Metrics
+	// Tracer finds the spans audits are added in. Defaults to no tracing.
+	Tracer Tracer
+	// CaptureTrace fills audit trace and span IDs from the context they are
+	// added with
+	CaptureTrace bool
 
 	initSync    sync.Once
 	recordsLock sync.Mutex
-	records     []*processoriface.Record
+	records     []*Record
+	queuedBytes int
+	dropped     uint64
+	closed      bool
+	// closed and replaced whenever records leave the queue
+	spaceAvailable chan struct{}
 
 	thresholdBreachOnce *sync.Once
 	thresholdBreachLock sync.Mutex
@@ -27,40 +84,200 @@ func (b *batch) init() {
 			b.Threshold = 1
 		}
 
+		if b.MaxRecordBytes == 0 {
+			b.MaxRecordBytes = kinesisRecordMaxBytes
+		}
+
+		if b.Metrics == nil {
+			b.Metrics = nopMetrics{}
+		}
+
+		if b.Tracer == nil {
+			b.Tracer = nopTracer{}
+		}
+
 		b.thresholdBreachOnce = new(sync.Once)
+		b.spaceAvailable = make(chan struct{})
+
+		// records may be replayed from a spool
+		for _, record := range b.records {
+			b.queuedBytes += record.size()
+		}
 	})
 }
 
 // Add adds a record to the batch
 func (b *batch) Add(audit *Audit) error {
+	return b.AddContext(context.Background(), audit)
+}
+
+// AddContext adds a record to the batch. If the queue is full under
+// OverflowBlock it waits until there is room or ctx is done.
+func (b *batch) AddContext(ctx context.Context, audit *Audit) error {
+	return b.add(ctx, audit, nil)
+}
+
+// AddWithReceipt adds a record to the batch, returning a receipt resolved
+// when it is delivered or given up on
+func (b *batch) AddWithReceipt(ctx context.Context, audit *Audit) (*Receipt, error) {
+	receipt := newReceipt()
+	if err := b.add(ctx, audit, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+func (b *batch) add(ctx context.Context, audit *Audit, receipt *Receipt) error {
 	b.init()
 
-	if err := audit.fillOptional(); err != nil {
-		return err
+	if b.CaptureTrace {
+		captureTrace(ctx, b.Tracer, audit)
 	}
 
-	data, err := json.Marshal(audit)
+	record, err := newRecord(audit, b.PartitionKey, b.ServiceName)
 	if err != nil {
 		return err
 	}
+	record.spanContext = b.Tracer.SpanContext(ctx)
+	record.receipt = receipt
+
+	if err := record.checkSize(b.MaxRecordBytes); err != nil {
+		return err
+	}
 
 	b.recordsLock.Lock()
 	defer b.recordsLock.Unlock()
 
-	b.records = append(b.records, &processoriface.Record{
-		Data: data,
-		Key:  string(audit.UUID),
-	})
+	if err := b.makeRoom(ctx, record.size()); err != nil {
+		return err
+	}
+	// nothing sends records queued after the runner stops
+	if b.closed {
+		return ErrBatcherStopped
+	}
+
+	if b.Spool != nil {
+		if err := b.Spool.Append(record); err != nil {
+			return err
+		}
+	}
 
+	b.records = append(b.records, record)
+	b.queuedBytes += record.size()
+	b.Metrics.AuditsAdded(1)
+	b.Metrics.QueueDepth(b.Name, len(b.records))
+
+	if b.overThreshold() {
+		b.breachThreshold()
+	}
+
+	return nil
+}
+
+// overThreshold returns whether enough records are queued to send a batch.
+// recordsLock must be held.
+func (b *batch) overThreshold() bool {
 	if len(b.records) >= b.Threshold {
-		b.getThresholdBreachOnce().Do(func() {
-			b.thresholdBreach <- struct{}{}
-		})
+		return true
+	}
+	return b.ThresholdBytes > 0 && b.queuedBytes >= b.ThresholdBytes
+}
+
+// makeRoom applies the overflow policy until a record of size fits in the
+// queue. recordsLock must be held and is released while blocking.
+func (b *batch) makeRoom(ctx context.Context, size int) error {
+	for !b.hasRoom(size) {
+		switch b.Overflow {
+		case OverflowDropNewest:
+			b.dropped++
+			b.Metrics.AuditsDropped(1)
+			return ErrQueueFull
+		case OverflowDropOldest:
+			dropped := b.records[0]
+			b.records = b.records[1:]
+			b.queuedBytes -= dropped.size()
+			b.dropped++
+			b.Metrics.AuditsDropped(1)
+			resolveRecord(dropped, nil, ErrQueueFull)
+			if b.Spool != nil {
+				if err := b.Spool.Ack(dropped); err != nil {
+					return err
+				}
+			}
+		default:
+			if b.closed {
+				return ErrBatcherStopped
+			}
+
+			// send what is queued rather than waiting for the batch age
+			b.breachThreshold()
+
+			spaceAvailable := b.spaceAvailable
+			b.recordsLock.Unlock()
+			select {
+			case <-spaceAvailable:
+			case <-ctx.Done():
+				b.recordsLock.Lock()
+				return ctx.Err()
+			}
+			b.recordsLock.Lock()
+		}
 	}
 
 	return nil
 }
 
+func (b *batch) hasRoom(size int) bool {
+	if len(b.records) == 0 {
+		return true
+	}
+	if b.MaxQueueRecords > 0 && len(b.records) >= b.MaxQueueRecords {
+		return false
+	}
+	return b.MaxQueueBytes <= 0 || b.queuedBytes+size <= b.MaxQueueBytes
+}
+
+// Dropped returns the number of audits dropped by the overflow policy
+func (b *batch) Dropped() uint64 {
+	b.init()
+
+	b.recordsLock.Lock()
+	defer b.recordsLock.Unlock()
+	return b.dropped
+}
+
+// Close fails adds blocked on a full queue and resolves the receipts of
+// records that were never sent, returning them
+func (b *batch) Close() []*Record {
+	b.init()
+
+	b.recordsLock.Lock()
+	defer b.recordsLock.Unlock()
+	b.closed = true
+	b.signalSpaceAvailable()
+
+	records := b.records
+	for _, record := range records {
+		resolveRecord(record, nil, ErrBatcherStopped)
+	}
+	b.records = nil
+	b.queuedBytes = 0
+	return records
+}
+
+// signalSpaceAvailable wakes adds blocked on a full queue. recordsLock must be
+// held.
+func (b *batch) signalSpaceAvailable() {
+	close(b.spaceAvailable)
+	b.spaceAvailable = make(chan struct{})
+}
+
+func (b *batch) breachThreshold() {
+	b.getThresholdBreachOnce().Do(func() {
+		b.thresholdBreach <- struct{}{}
+	})
+}
+
 func (b *batch) CurrentSize() int {
 	b.init()
 
@@ -69,8 +286,9 @@ func (b *batch) CurrentSize() int {
 	return len(b.records)
 }
 
-// PopBatch pops a batch to send to kinesis
-func (b *batch) PopBatch(maxSize int) []*processoriface.Record {
+// PopBatch pops a batch to send to kinesis of at most maxSize records and
+// maxBytes total. A batch always has at least one record if any are queued.
+func (b *batch) PopBatch(maxSize, maxBytes int) []*Record {
 	b.init()
 
 	b.recordsLock.Lock()
@@ -80,19 +298,25 @@ func (b *batch) PopBatch(maxSize int) []*processoriface.Record {
 		return nil
 	}
 
-	if len(b.records) <= maxSize {
-		records := b.records
-		b.records = []*processoriface.Record{}
-		return records
+	size := chunkSize(b.records, TransportLimits{
+		MaxBatchRecords: maxSize,
+		MaxBatchBytes:   maxBytes,
+	})
+	var batchBytes int
+	for _, record := range b.records[:size] {
+		batchBytes += record.size()
 	}
 
-	records := b.records[0:maxSize]
-	if len(b.records) > maxSize {
-		b.records = b.records[maxSize:len(b.records)]
+	records := b.records[0:size]
+	if len(b.records) > size {
+		b.records = b.records[size:len(b.records)]
 	} else {
-		b.records = []*processoriface.Record{}
+		b.records = []*Record{}
 	}
 
+	b.queuedBytes -= batchBytes
+	b.Metrics.QueueDepth(b.Name, len(b.records))
+	b.signalSpaceAvailable()
 	return records
 }
 
@@ -105,7 +329,10 @@ func (b *batch) ThresholdBreach() <-chan struct{} {
 func (b *batch) ThresholdBreached() bool {
 	b.init()
 
-	return b.CurrentSize() >= b.Threshold
+	b.recordsLock.Lock()
+	defer b.recordsLock.Unlock()
+
+	return b.overThreshold()
 }
 
 func (b *batch) MarkThresholdBreachRead() {
@@ -4,80 +4,420 @@ import (
 	"context"
 	"fmt"
 	"time"
-
-	"code.justin.tv/foundation/history.v2/internal/batch/processoriface"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/kinesis"
-	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 )
 
-type kinesisProcessor struct {
-	StreamName  string
-	Kinesis     kinesisiface.KinesisAPI
-	Logger      Logger
+// transportProcessor sends batches through a transport, retrying failed records
+type transportProcessor struct {
+	Transport   Transport
+	Logger      LeveledLogger
 	RunnerState *runnerState
+
+	// Spool, if set, is acknowledged as records are sent
+	Spool *spool
+
+	// MaxAttempts is the number of times a record is sent before it is dead
+	// lettered. Zero retries until stopped.
+	MaxAttempts int
+	// MaxRecordAge is how long after its first attempt a record is dead
+	// lettered. Zero retries until stopped.
+	MaxRecordAge time.Duration
+	// DeadLetterSink receives records that could not be sent. If nil, they are
+	// logged.
+	DeadLetterSink DeadLetterSink
+	// RetryPolicy paces retries and decides which failures are retried.
+	// Defaults to ExponentialBackoff.
+	RetryPolicy RetryPolicy
+	Metrics     Metrics
+	// Tracer creates spans for batches. Defaults to no tracing.
+	Tracer Tracer
+}
+
+// pendingRecord tracks attempts to send a record
+type pendingRecord struct {
+	Record         *Record
+	Attempts       int
+	FirstAttemptAt time.Time
+	ErrorCode      string
+	ErrorMessage   string
+	Delivered      bool
+}
+
+// err is the error of a record that will not be retried
+func (p *pendingRecord) err() error {
+	return &RecordFailedError{ErrorCode: p.ErrorCode, ErrorMessage: p.ErrorMessage}
 }
 
-func (kp *kinesisProcessor) Process(ctx context.Context, batch []*processoriface.Record) {
-	var records []*kinesis.PutRecordsRequestEntry
+// Process sends a batch, returning an error if any record was dead lettered or
+// left unsent when the runner stopped
+func (tp *transportProcessor) Process(ctx context.Context, batch []*Record) error {
+	var records []*Record
+	pending := make(map[*Record]*pendingRecord, len(batch))
 	for _, rec := range batch {
 		if rec == nil {
 			continue
 		}
 
-		records = append(records, &kinesis.PutRecordsRequestEntry{
-			Data:         rec.Data,
-			PartitionKey: aws.String(rec.Key),
-		})
+		records = append(records, rec)
+		pending[rec] = &pendingRecord{Record: rec}
+	}
+
+	ctx, span := tp.tracer().Start(ctx, "historyin.Process", SpanOptions{
+		Attributes: append(transportAttributes(tp.Transport), recordsAttributes(records)...),
+		Links:      recordLinks(records),
+	})
+
+	tp.sendBatch(ctx, records, pending)
+
+	var nUndelivered, nRetries int
+	var lastErrorMessage string
+	for _, rec := range records {
+		p := pending[rec]
+		if p.Attempts > 1 {
+			nRetries += p.Attempts - 1
+		}
+		if !p.Delivered {
+			nUndelivered++
+			lastErrorMessage = p.ErrorMessage
+		}
+	}
+	span.SetAttributes(
+		Attribute{Key: attrRetries, Value: nRetries},
+		Attribute{Key: attrFailedRecords, Value: nUndelivered},
+	)
+
+	var err error
+	if nUndelivered > 0 {
+		err = fmt.Errorf("%d of %d records not delivered: %s", nUndelivered, len(records), lastErrorMessage)
 	}
+	span.End(err)
+	return err
+}
 
-	kp.sendBatch(ctx, records)
+func (tp *transportProcessor) tracer() Tracer {
+	if tp.Tracer == nil {
+		return nopTracer{}
+	}
+	return tp.Tracer
+}
+
+// recordLinks links to the spans records were added in
+func recordLinks(records []*Record) []SpanContext {
+	var links []SpanContext
+	for _, rec := range records {
+		if rec.spanContext != nil {
+			links = append(links, rec.spanContext)
+		}
+	}
+	return links
 }
 
-func (kp *kinesisProcessor) sendBatch(ctx context.Context, batch []*kinesis.PutRecordsRequestEntry) {
+func (tp *transportProcessor) sendBatch(ctx context.Context, batch []*Record, pending map[*Record]*pendingRecord) {
+	policy := tp.retryPolicy()
+
+	// retries since records were last sent
 	var nTry int
-	for len(batch) > 0 && !kp.RunnerState.Stopped() {
-		output, err := kp.Kinesis.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{
-			StreamName: aws.String(kp.StreamName),
-			Records:    batch,
-		})
-		if err != nil {
-			if awsErr, ok := err.(awserr.Error); ok {
-				switch awsErr.Code() {
-				case kinesis.ErrCodeProvisionedThroughputExceededException:
+	for len(batch) > 0 && !tp.RunnerState.Stopped() {
+		if nTry > 0 {
+			backoff := policy.Backoff(nTry)
+			tp.Logger.Debug("retrying records",
+				"stream", transportStreamName(tp.Transport),
+				"retry", nTry,
+				"records", len(batch),
+				"backoff", backoff)
+			tp.wait(ctx, backoff)
+			if tp.RunnerState.Stopped() {
+				break
+			}
+		}
+
+		results, err := tp.Transport.PutBatch(ctx, batch)
+		if openErr, ok := err.(*CircuitOpenError); ok {
+			// park records without using up attempts until the breaker lets a
+			// trial call through
+			wait := time.Until(openErr.Until)
+			if wait < retryBaseDelay {
+				// a trial call is already in flight
+				wait = retryBaseDelay
+			}
+			tp.Logger.Debug("holding records while circuit breaker is open",
+				"stream", transportStreamName(tp.Transport),
+				"records", len(batch),
+				"until", openErr.Until)
+			tp.wait(ctx, wait)
+			nTry = 0
+			continue
+		}
+
+		tp.markAttempted(batch, pending)
+		if err == nil {
+			var failed []*Record
+			if failed, err = tp.failedOnly(batch, results); err == nil {
+				tp.markResults(batch, results, pending)
+				tp.ack(batch, results)
+
+				// start backing off again once records get through
+				if len(failed) < len(batch) {
+					nTry = 1
+				} else {
 					nTry++
-					kp.RunnerState.Wait(time.Duration(nTry) * 100 * time.Millisecond)
 				}
+				batch = tp.withinLimits(tp.retryableOnly(failed, pending), pending)
+				continue
 			}
-			kp.Logger.Error(fmt.Errorf("error putting to kinesis: %s", err.Error()))
-			continue
+			tp.Logger.Warn("error validating batch results",
+				"stream", transportStreamName(tp.Transport),
+				"records", len(batch),
+				"error", err)
+		} else {
+			tp.Logger.Warn("error putting batch",
+				"stream", transportStreamName(tp.Transport),
+				"records", len(batch),
+				"error_code", errorCode(err),
+				"error", err)
 		}
 
-		batch, err = kp.failedOnly(batch, output)
-		if err != nil {
-			kp.Logger.Error(fmt.Errorf("error validating kinesis batch: %s", err.Error()))
-			continue
+		code := errorCode(err)
+		for _, rec := range batch {
+			pending[rec].ErrorCode = code
+			pending[rec].ErrorMessage = err.Error()
 		}
+		tp.measureFailed(code, len(batch))
+
+		if !policy.Retryable(err) {
+			tp.deadLetter(batch, pending)
+			return
+		}
+
+		nTry++
+		batch = tp.withinLimits(batch, pending)
+	}
 
+	for _, rec := range batch {
+		resolveRecord(rec, nil, ErrBatcherStopped)
+	}
+
+	// records left in the spool are replayed by the next batcher
+	if len(batch) > 0 && tp.Spool == nil {
+		for _, rec := range batch {
+			pending[rec].ErrorCode = ""
+			pending[rec].ErrorMessage = ErrBatcherStopped.Error()
+		}
+		tp.deadLetter(batch, pending)
 	}
 }
 
-func (kp *kinesisProcessor) failedOnly(batch []*kinesis.PutRecordsRequestEntry, output *kinesis.PutRecordsOutput) ([]*kinesis.PutRecordsRequestEntry, error) {
-	if len(batch) != len(output.Records) {
+func (tp *transportProcessor) metrics() Metrics {
+	if tp.Metrics == nil {
+		return nopMetrics{}
+	}
+	return tp.Metrics
+}
+
+// measureFailed counts failed records, including throttles
+func (tp *transportProcessor) measureFailed(errorCode string, n int) {
+	tp.metrics().RecordsFailed(errorCode, n)
+	if throttleErrorCodes[errorCode] {
+		tp.metrics().RecordsThrottled(n)
+	}
+}
+
+func (tp *transportProcessor) retryPolicy() RetryPolicy {
+	if tp.RetryPolicy == nil {
+		return &ExponentialBackoff{}
+	}
+	return tp.RetryPolicy
+}
+
+// wait sleeps for d or until the runner is stopped
+func (tp *transportProcessor) wait(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// markResults records which records were delivered and the errors of the rest
+func (tp *transportProcessor) markResults(batch []*Record, results []*RecordResult, pending map[*Record]*pendingRecord) {
+	var nSent int
+	failedByCode := make(map[string]int)
+	for nItem, result := range results {
+		p := pending[batch[nItem]]
+		if result.Failed() {
+			p.ErrorCode = result.ErrorCode
+			p.ErrorMessage = result.ErrorMessage
+			failedByCode[result.ErrorCode]++
+		} else {
+			p.Delivered = true
+			nSent++
+			resolveRecord(p.Record, &Delivery{
+				SequenceNumber: result.SequenceNumber,
+				ShardID:        result.ShardID,
+			}, nil)
+		}
+	}
+
+	if nSent > 0 {
+		tp.metrics().RecordsSent(nSent)
+	}
+	for errorCode, n := range failedByCode {
+		tp.measureFailed(errorCode, n)
+	}
+}
+
+// retryableOnly dead letters failed records the retry policy will not retry
+// and returns the rest
+func (tp *transportProcessor) retryableOnly(failed []*Record, pending map[*Record]*pendingRecord) []*Record {
+	policy := tp.retryPolicy()
+
+	var fatal []*Record
+	retryable := make([]*Record, 0, len(failed))
+	for _, rec := range failed {
+		p := pending[rec]
+		if !policy.Retryable(&RecordFailedError{ErrorCode: p.ErrorCode, ErrorMessage: p.ErrorMessage}) {
+			fatal = append(fatal, rec)
+			continue
+		}
+		retryable = append(retryable, rec)
+	}
+
+	tp.deadLetter(fatal, pending)
+	return retryable
+}
+
+func (tp *transportProcessor) failedOnly(batch []*Record, results []*RecordResult) ([]*Record, error) {
+	if len(batch) != len(results) {
 		return nil, errInvalidPutBatchResponse
 	}
 
-	newBatch := make([]*kinesis.PutRecordsRequestEntry, 0, len(output.Records))
-	for nItem, item := range output.Records {
-		if item.ErrorCode == nil {
+	newBatch := make([]*Record, 0, len(results))
+	for nItem, result := range results {
+		if !result.Failed() {
 			continue
 		}
-		// ErrorCodes can be either ProvisionedThroughputExceededException or InternalFailure.
-		// Retry in both cases.
-		kp.Logger.Error(fmt.Errorf("error sending records to kinesis: %s", aws.StringValue(item.ErrorMessage)))
+		tp.Logger.Warn("error sending record",
+			"stream", transportStreamName(tp.Transport),
+			"partition_key", batch[nItem].PartitionKey,
+			"error_code", result.ErrorCode,
+			"error", result.ErrorMessage)
 		newBatch = append(newBatch, batch[nItem])
 	}
 
 	return newBatch, nil
 }
+
+func (tp *transportProcessor) markAttempted(batch []*Record, pending map[*Record]*pendingRecord) {
+	now := time.Now()
+	var nRetried int
+	for _, rec := range batch {
+		p := pending[rec]
+		if p.Attempts == 0 {
+			p.FirstAttemptAt = now
+		} else {
+			nRetried++
+		}
+		p.Attempts++
+	}
+
+	if nRetried > 0 {
+		tp.metrics().RecordsRetried(nRetried)
+	}
+}
+
+// withinLimits dead letters records that have used up their attempts or age
+// and returns the rest
+func (tp *transportProcessor) withinLimits(batch []*Record, pending map[*Record]*pendingRecord) []*Record {
+	if tp.MaxAttempts <= 0 && tp.MaxRecordAge <= 0 {
+		return batch
+	}
+
+	now := time.Now()
+	var expired []*Record
+	newBatch := make([]*Record, 0, len(batch))
+	for _, rec := range batch {
+		p := pending[rec]
+		if (tp.MaxAttempts > 0 && p.Attempts >= tp.MaxAttempts) ||
+			(tp.MaxRecordAge > 0 && now.Sub(p.FirstAttemptAt) >= tp.MaxRecordAge) {
+			expired = append(expired, rec)
+			continue
+		}
+		newBatch = append(newBatch, rec)
+	}
+
+	tp.deadLetter(expired, pending)
+	return newBatch
+}
+
+// Abandon dead letters records the runner stopped before sending
+func (tp *transportProcessor) Abandon(batch []*Record) {
+	pending := make(map[*Record]*pendingRecord, len(batch))
+	for _, rec := range batch {
+		pending[rec] = &pendingRecord{Record: rec, ErrorMessage: ErrBatcherStopped.Error()}
+	}
+	tp.deadLetter(batch, pending)
+}
+
+// deadLetter hands records that will not be retried to the dead letter sink
+func (tp *transportProcessor) deadLetter(batch []*Record, pending map[*Record]*pendingRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	records := make([]*Record, 0, len(batch))
+	for _, rec := range batch {
+		p := pending[rec]
+		letter := &DeadLetter{
+			PartitionKey:   p.Record.PartitionKey,
+			Data:           p.Record.Data,
+			ErrorCode:      p.ErrorCode,
+			ErrorMessage:   p.ErrorMessage,
+			Attempts:       p.Attempts,
+			FirstAttemptAt: p.FirstAttemptAt,
+		}
+
+		resolveRecord(p.Record, nil, p.err())
+
+		if tp.DeadLetterSink == nil {
+			tp.Logger.Error("dropping record",
+				"stream", transportStreamName(tp.Transport),
+				"partition_key", letter.PartitionKey,
+				"attempts", letter.Attempts,
+				"error_code", letter.ErrorCode,
+				"error", letter.ErrorMessage,
+				"record", string(letter.Data))
+		} else if err := tp.DeadLetterSink.Put(letter); err != nil {
+			tp.Logger.Error("error dead lettering record",
+				"partition_key", letter.PartitionKey,
+				"error", err,
+				"record", string(letter.Data))
+			continue
+		}
+		records = append(records, p.Record)
+	}
+
+	if tp.Spool != nil {
+		if err := tp.Spool.Ack(records...); err != nil {
+			tp.Logger.Error("error acknowledging spooled records", "error", err)
+		}
+	}
+}
+
+// ack acknowledges sent records in the spool
+func (tp *transportProcessor) ack(batch []*Record, results []*RecordResult) {
+	if tp.Spool == nil {
+		return
+	}
+
+	sent := make([]*Record, 0, len(batch))
+	for nItem, result := range results {
+		if !result.Failed() {
+			sent = append(sent, batch[nItem])
+		}
+	}
+
+	if err := tp.Spool.Ack(sent...); err != nil {
+		tp.Logger.Error("error acknowledging spooled records", "error", err)
+	}
+}
@@ -1,84 +1,337 @@
 package historyin
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"code.justin.tv/foundation/history.v2/mocks"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
 
-type KinesisProcessorSuite struct {
+// countingRetryPolicy records backoffs without waiting
+type countingRetryPolicy struct {
+	retries []int
+}
+
+func (p *countingRetryPolicy) Backoff(retry int) time.Duration {
+	p.retries = append(p.retries, retry)
+	return 0
+}
+
+func (p *countingRetryPolicy) Retryable(err error) bool {
+	return true
+}
+
+type TransportProcessorSuite struct {
 	suite.Suite
 	mockKinesis *mocks.KinesisAPI
-	processor   *kinesisProcessor
+	processor   *transportProcessor
 }
 
-func (s *KinesisProcessorSuite) SetupTest() {
+func (s *TransportProcessorSuite) SetupTest() {
 	s.mockKinesis = new(mocks.KinesisAPI)
-	s.processor = &kinesisProcessor{
-		StreamName:  "mock",
+	s.processor = &transportProcessor{
 		RunnerState: new(runnerState),
 		Logger:      nopLogger{},
-		Kinesis:     s.mockKinesis,
+		RetryPolicy: &ExponentialBackoff{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		Transport: &KinesisTransport{
+			StreamName: "mock",
+			Kinesis:    s.mockKinesis,
+		},
 	}
 }
 
-func (s *KinesisProcessorSuite) TearDownTest() {
+func (s *TransportProcessorSuite) TearDownTest() {
 	s.mockKinesis.AssertExpectations(s.T())
 }
 
-func (s *KinesisProcessorSuite) TestFailedOnlyEmptyBatch() {
+func (s *TransportProcessorSuite) TestFailedOnlyEmptyBatch() {
 	fb, err := s.processor.failedOnly(
-		[]*kinesis.PutRecordsRequestEntry{},
-		&kinesis.PutRecordsOutput{
-			Records: []*kinesis.PutRecordsResultEntry{},
-		})
+		[]*Record{},
+		[]*RecordResult{})
 
 	s.Require().NoError(err)
 	s.Assert().Empty(fb)
 }
 
-func (s *KinesisProcessorSuite) TestFailedOnlyDifferentLens() {
+func (s *TransportProcessorSuite) TestFailedOnlyDifferentLens() {
 	_, err := s.processor.failedOnly(
-		[]*kinesis.PutRecordsRequestEntry{
+		[]*Record{
 			{},
 		},
-		&kinesis.PutRecordsOutput{
-			Records: []*kinesis.PutRecordsResultEntry{},
-		})
+		[]*RecordResult{})
 
 	s.Assert().Equal(errInvalidPutBatchResponse, err)
 }
 
-func (s *KinesisProcessorSuite) TestFailedOnlyAllFailed() {
-	records := []*kinesis.PutRecordsRequestEntry{{}}
+func (s *TransportProcessorSuite) TestFailedOnlyAllFailed() {
+	records := []*Record{{}}
 	fb, err := s.processor.failedOnly(
 		records,
-		&kinesis.PutRecordsOutput{
-			Records: []*kinesis.PutRecordsResultEntry{
-				{ErrorCode: aws.String("error-code")},
-			},
+		[]*RecordResult{
+			{ErrorCode: "error-code"},
 		})
 
 	s.Assert().NoError(err)
 	s.Assert().Equal(records, fb)
 }
 
-func (s *KinesisProcessorSuite) TestFailedOnlyNoFailed() {
+func (s *TransportProcessorSuite) TestFailedOnlyLogsFailures() {
+	logger := &recordingLogger{}
+	s.processor.Logger = NewLeveledLogger(logger)
+	_, err := s.processor.failedOnly(
+		[]*Record{{PartitionKey: "my-key"}},
+		[]*RecordResult{
+			{ErrorCode: "error-code", ErrorMessage: "error-message"},
+		})
+
+	s.Require().NoError(err)
+	s.Assert().Equal([]error{
+		errors.New("error sending record stream=mock partition_key=my-key error_code=error-code error=error-message"),
+	}, logger.errs)
+}
+
+func (s *TransportProcessorSuite) TestFailedOnlyNoFailed() {
 	fb, err := s.processor.failedOnly(
-		[]*kinesis.PutRecordsRequestEntry{{}},
-		&kinesis.PutRecordsOutput{
-			Records: []*kinesis.PutRecordsResultEntry{
-				{},
-			},
+		[]*Record{{}},
+		[]*RecordResult{
+			{},
 		})
 
 	s.Assert().NoError(err)
 	s.Assert().Empty(fb)
 }
 
+func (s *TransportProcessorSuite) TestProcessAcksSpool() {
+	dir, err := ioutil.TempDir("", "historyin-processor")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	sp, _, err := openSpool(dir, nopLogger{})
+	s.Require().NoError(err)
+	s.processor.Spool = sp
+
+	records := []*Record{
+		{PartitionKey: "sent", Data: []byte("{}")},
+		{PartitionKey: "failed", Data: []byte("{}")},
+	}
+	for _, rec := range records {
+		s.Require().NoError(sp.Append(rec))
+	}
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{},
+				{ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)},
+			},
+		}, nil).
+		Once()
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			input := args.Get(1).(*kinesis.PutRecordsInput)
+			s.Require().Len(input.Records, 1)
+			s.Assert().Equal("failed", aws.StringValue(input.Records[0].PartitionKey))
+			s.Assert().Len(sp.pending, 1, "sent record should be acknowledged")
+		}).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{{}},
+		}, nil).
+		Once()
+
+	s.Require().NoError(s.processor.Process(context.Background(), records))
+	s.Assert().Empty(sp.pending)
+	s.Require().NoError(sp.Close())
+}
+
+func (s *TransportProcessorSuite) TestProcessDeadLettersAfterMaxAttempts() {
+	sink := new(recordingDeadLetterSink)
+	s.processor.MaxAttempts = 2
+	s.processor.DeadLetterSink = sink
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{
+					ErrorCode:    aws.String("InternalFailure"),
+					ErrorMessage: aws.String("internal failure"),
+				},
+			},
+		}, nil).
+		Twice()
+
+	err := s.processor.Process(context.Background(), []*Record{
+		{PartitionKey: "my-key", Data: []byte("{}")},
+	})
+	s.Assert().EqualError(err, "1 of 1 records not delivered: internal failure")
+
+	s.Require().Len(sink.letters, 1)
+	letter := sink.letters[0]
+	s.Assert().Equal("my-key", letter.PartitionKey)
+	s.Assert().Equal([]byte("{}"), letter.Data)
+	s.Assert().Equal("InternalFailure", letter.ErrorCode)
+	s.Assert().Equal("internal failure", letter.ErrorMessage)
+	s.Assert().Equal(2, letter.Attempts)
+	s.Assert().False(letter.FirstAttemptAt.IsZero())
+}
+
+func (s *TransportProcessorSuite) TestProcessDeadLettersAfterMaxRecordAge() {
+	sink := new(recordingDeadLetterSink)
+	s.processor.MaxRecordAge = time.Nanosecond
+	s.processor.DeadLetterSink = sink
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil)).
+		Once()
+
+	s.processor.Process(context.Background(), []*Record{
+		{PartitionKey: "my-key", Data: []byte("{}")},
+	})
+
+	s.Require().Len(sink.letters, 1)
+	s.Assert().Equal(kinesis.ErrCodeProvisionedThroughputExceededException, sink.letters[0].ErrorCode)
+	s.Assert().Equal(1, sink.letters[0].Attempts)
+}
+
+func (s *TransportProcessorSuite) TestProcessDeadLettersFatalError() {
+	sink := new(recordingDeadLetterSink)
+	s.processor.DeadLetterSink = sink
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "stream not found", nil)).
+		Once()
+
+	err := s.processor.Process(context.Background(), []*Record{
+		{PartitionKey: "my-key", Data: []byte("{}")},
+	})
+	s.Assert().Error(err)
+
+	s.Require().Len(sink.letters, 1)
+	s.Assert().Equal(kinesis.ErrCodeResourceNotFoundException, sink.letters[0].ErrorCode)
+	s.Assert().Equal(1, sink.letters[0].Attempts)
+}
+
+func (s *TransportProcessorSuite) TestProcessDeadLettersFatalRecords() {
+	sink := new(recordingDeadLetterSink)
+	s.processor.DeadLetterSink = sink
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{ErrorCode: aws.String(kinesis.ErrCodeKMSAccessDeniedException)},
+				{ErrorCode: aws.String("InternalFailure")},
+			},
+		}, nil).
+		Once()
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			input := args.Get(1).(*kinesis.PutRecordsInput)
+			s.Require().Len(input.Records, 1)
+			s.Assert().Equal("retryable", aws.StringValue(input.Records[0].PartitionKey))
+		}).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{{}},
+		}, nil).
+		Once()
+
+	s.processor.Process(context.Background(), []*Record{
+		{PartitionKey: "fatal", Data: []byte("{}")},
+		{PartitionKey: "retryable", Data: []byte("{}")},
+	})
+
+	s.Require().Len(sink.letters, 1)
+	s.Assert().Equal("fatal", sink.letters[0].PartitionKey)
+}
+
+func (s *TransportProcessorSuite) TestProcessParksWhileCircuitOpen() {
+	breaker := &CircuitBreaker{FailureThreshold: 1, Cooldown: 10 * time.Millisecond}
+	breaker.record(true)
+	s.processor.Transport = &breakerTransport{Transport: s.processor.Transport, Breaker: breaker}
+	s.processor.MaxAttempts = 1
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{{}},
+		}, nil).
+		Once()
+
+	s.Require().NoError(s.processor.Process(context.Background(), []*Record{
+		{PartitionKey: "my-key", Data: []byte("{}")},
+	}), "parked record should not use up attempts")
+	s.Assert().Equal(CircuitClosed, breaker.State())
+}
+
+func (s *TransportProcessorSuite) TestProcessBacksOff() {
+	policy := &countingRetryPolicy{}
+	s.processor.RetryPolicy = policy
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(nil, errors.New("connection reset")).
+		Twice()
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{{}, {ErrorCode: aws.String("InternalFailure")}},
+		}, nil).
+		Once()
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{{}},
+		}, nil).
+		Once()
+
+	s.Require().NoError(s.processor.Process(context.Background(), []*Record{
+		{PartitionKey: "a", Data: []byte("{}")},
+		{PartitionKey: "b", Data: []byte("{}")},
+	}))
+	s.Assert().Equal([]int{1, 2, 1}, policy.retries, "backoff should reset after progress")
+}
+
+func (s *TransportProcessorSuite) TestProcessDeadLettersOnStop() {
+	sink := new(recordingDeadLetterSink)
+	s.processor.DeadLetterSink = sink
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			s.processor.RunnerState.Stop()
+		}).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{},
+				{ErrorCode: aws.String("InternalFailure")},
+			},
+		}, nil).
+		Once()
+
+	s.processor.Process(context.Background(), []*Record{
+		{PartitionKey: "sent", Data: []byte("{}")},
+		{PartitionKey: "unsent", Data: []byte("{}")},
+	})
+
+	s.Require().Len(sink.letters, 1)
+	s.Assert().Equal("unsent", sink.letters[0].PartitionKey)
+	s.Assert().Equal(ErrBatcherStopped.Error(), sink.letters[0].ErrorMessage)
+}
+
 func TestBatchProcessor(t *testing.T) {
-	suite.Run(t, &KinesisProcessorSuite{})
+	suite.Run(t, &TransportProcessorSuite{})
 }
@@ -3,25 +3,73 @@ package historyin
 import (
 	"context"
 	"errors"
+	"hash/fnv"
+	"sync"
 	"time"
-
-	"code.justin.tv/foundation/history.v2/internal/batch/processoriface"
-)
-
-const (
-	kinesisBatchMaxRecords = 500
 )
 
 var (
 	errInvalidPutBatchResponse = errors.New("invalid put batch response")
+
+	_ Batcher      = (*batchRunner)(nil)
+	_ ContextAdder = (*batchRunner)(nil)
+	_ ReceiptAdder = (*batchRunner)(nil)
+	_ DropCounter  = (*batchRunner)(nil)
+	_ Flusher      = (*batchRunner)(nil)
 )
 
+// processor sends batches of records
+type processor interface {
+	// Process returns once every record is sent or given up on
+	Process(ctx context.Context, batch []*Record) error
+	// Abandon gives up on records the runner stopped before processing
+	Abandon(batch []*Record)
+}
+
 // BatchRunner sends batches to kinesis
 type batchRunner struct {
 	MaxBatchAge    time.Duration
 	Batch          batch
-	BatchProcessor processoriface.ProcessorAPI
+	BatchProcessor processor
 	RunnerState    *runnerState
+	Logger         LeveledLogger
+	Metrics        Metrics
+
+	// Limits cut batches to fit the transport. Defaults to kinesis limits.
+	Limits TransportLimits
+
+	// Senders is how many batches are processed at once. Records with the
+	// same partition key are always processed in order by the same sender.
+	// Defaults to 1, processing batches in Run.
+	Senders int
+	// MaxInFlight caps batches waiting for or being processed by senders.
+	// Defaults to Senders.
+	MaxInFlight int
+
+	initSync      sync.Once
+	flushRequests chan chan error
+	runDone       chan struct{}
+
+	// queue of each sender and a slot for each batch in flight
+	senders     []chan sendJob
+	inFlight    chan struct{}
+	sendersDone sync.WaitGroup
+}
+
+// sendJob is a batch for a sender, or a barrier if batch is nil
+type sendJob struct {
+	ctx   context.Context
+	batch []*Record
+	// done receives the last error processing batches since the previous
+	// barrier once the sender reaches a barrier
+	done chan error
+}
+
+func (br *batchRunner) init() {
+	br.initSync.Do(func() {
+		br.flushRequests = make(chan chan error)
+		br.runDone = make(chan struct{})
+	})
 }
 
 // Add adds an audit to the batch
@@ -29,28 +77,100 @@ func (br *batchRunner) Add(audit *Audit) error {
 	return br.Batch.Add(audit)
 }
 
+// AddContext adds an audit to the batch, waiting on ctx if the queue is full
+func (br *batchRunner) AddContext(ctx context.Context, audit *Audit) error {
+	return br.Batch.AddContext(ctx, audit)
+}
+
+// AddWithReceipt adds an audit to the batch, returning a receipt resolved when
+// it is delivered or given up on
+func (br *batchRunner) AddWithReceipt(ctx context.Context, audit *Audit) (*Receipt, error) {
+	return br.Batch.AddWithReceipt(ctx, audit)
+}
+
+// Dropped returns the number of audits dropped because the queue was full
+func (br *batchRunner) Dropped() uint64 {
+	return br.Batch.Dropped()
+}
+
 // BatchSize returns the size of the batch
 func (br *batchRunner) CurrentBatchSize() int {
 	return br.Batch.CurrentSize()
 }
 
+// Flush sends every record queued when it is called and waits for batches
+// senders are processing. It returns once they are sent, or with an error if
+// any batch since the previous Flush was not, ErrBatcherStopped if the runner
+// stopped first, or ctx.Err() if ctx is done first.
+func (br *batchRunner) Flush(ctx context.Context) error {
+	br.init()
+
+	flushed := make(chan error, 1)
+	select {
+	case br.flushRequests <- flushed:
+	case <-br.runDone:
+		return ErrBatcherStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-flushed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Run pushes batches to kinesis
 func (br *batchRunner) Run() {
+	br.init()
+	defer close(br.runDone)
+
+	if br.Limits == (TransportLimits{}) {
+		br.Limits = kinesisLimits
+	}
+
+	if br.Metrics == nil {
+		br.Metrics = nopMetrics{}
+	}
+
+	br.startSenders()
 	for !br.RunnerState.Stopped() {
 		ctx := br.RunnerState.Context()
-		br.waitForWork(ctx)
-		batch := br.Batch.PopBatch(kinesisBatchMaxRecords)
+		if flushed := br.waitForWork(ctx); flushed != nil {
+			flushed <- br.flush(ctx)
+			continue
+		}
+
+		batch := br.Batch.PopBatch(br.Limits.MaxBatchRecords, br.Limits.MaxBatchBytes)
 		if len(batch) > 0 {
-			br.BatchProcessor.Process(ctx, batch)
+			br.send(ctx, batch)
 		}
 	}
+	br.stopSenders()
+
+	// records left in the spool are replayed by the next batcher
+	unsent := br.Batch.Close()
+	if br.Batch.Spool == nil {
+		br.BatchProcessor.Abandon(unsent)
+	} else if err := br.Batch.Spool.Close(); err != nil {
+		br.Logger.Error("error closing spool", "error", err)
+	}
 
 	br.RunnerState.MarkDone()
 }
 
-func (br *batchRunner) waitForWork(ctx context.Context) {
+// waitForWork waits until a batch should be sent, returning the reply channel
+// of a flush request if one is received
+func (br *batchRunner) waitForWork(ctx context.Context) chan error {
 	if br.RunnerState.IsDraining() {
-		return
+		select {
+		case flushed := <-br.flushRequests:
+			return flushed
+		default:
+			return nil
+		}
 	}
 
 	select {
@@ -58,7 +178,153 @@ func (br *batchRunner) waitForWork(ctx context.Context) {
 	case <-time.NewTimer(br.MaxBatchAge).C:
 	case <-br.Batch.ThresholdBreach():
 		br.Batch.MarkThresholdBreachRead()
+	case flushed := <-br.flushRequests:
+		return flushed
+	}
+	return nil
+}
+
+// startSenders starts the senders when there is more than one
+func (br *batchRunner) startSenders() {
+	if br.Senders <= 1 {
+		return
+	}
+
+	if br.MaxInFlight < br.Senders {
+		br.MaxInFlight = br.Senders
+	}
+	br.inFlight = make(chan struct{}, br.MaxInFlight)
+	br.senders = make([]chan sendJob, br.Senders)
+	for i := range br.senders {
+		br.senders[i] = make(chan sendJob, br.MaxInFlight)
+		br.sendersDone.Add(1)
+		go br.runSender(br.senders[i])
+	}
+}
+
+// stopSenders waits for the senders to finish their queued batches
+func (br *batchRunner) stopSenders() {
+	for _, jobs := range br.senders {
+		close(jobs)
+	}
+	br.sendersDone.Wait()
+}
+
+func (br *batchRunner) runSender(jobs <-chan sendJob) {
+	defer br.sendersDone.Done()
+
+	// last error since the previous barrier
+	var sendErr error
+	for job := range jobs {
+		if job.batch == nil {
+			job.done <- sendErr
+			sendErr = nil
+			continue
+		}
+
+		if err := br.process(job.ctx, job.batch); err != nil {
+			sendErr = err
+		}
+		<-br.inFlight
+	}
+}
+
+// send processes a batch, splitting it between the senders by partition key
+// if there are any. Without senders it returns the error from the processor.
+func (br *batchRunner) send(ctx context.Context, batch []*Record) error {
+	if len(br.senders) == 0 {
+		return br.process(ctx, batch)
+	}
+
+	groups := make([][]*Record, len(br.senders))
+	for _, record := range batch {
+		i := senderIndex(record, len(br.senders))
+		groups[i] = append(groups[i], record)
+	}
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		br.inFlight <- struct{}{}
+		br.senders[i] <- sendJob{ctx: ctx, batch: group}
+	}
+	return nil
+}
+
+// waitForSenders waits until the senders have processed every batch sent to
+// them, returning the last error from the processor since it was last called
+func (br *batchRunner) waitForSenders() error {
+	dones := make([]chan error, len(br.senders))
+	for i, jobs := range br.senders {
+		dones[i] = make(chan error, 1)
+		jobs <- sendJob{done: dones[i]}
+	}
+
+	var sendErr error
+	for _, done := range dones {
+		if err := <-done; err != nil {
+			sendErr = err
+		}
+	}
+	return sendErr
+}
+
+// senderIndex picks the sender of a record from the key kinesis shards it by
+func senderIndex(record *Record, senders int) int {
+	key := record.PartitionKey
+	if record.ExplicitHashKey != "" {
+		key = record.ExplicitHashKey
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(senders))
+}
+
+// process sends a batch, measuring it
+func (br *batchRunner) process(ctx context.Context, batch []*Record) error {
+	var batchBytes int
+	for _, record := range batch {
+		batchBytes += record.size()
+	}
+	br.Metrics.BatchSent(len(batch), batchBytes)
+
+	start := time.Now()
+	err := br.BatchProcessor.Process(ctx, batch)
+	br.Metrics.BatchFlushed(time.Since(start))
+	return err
+}
+
+// flush processes every queued record and waits for the senders, returning
+// the last error from the processor. Records added while flushing are left for
+// later batches.
+func (br *batchRunner) flush(ctx context.Context) error {
+	var flushErr error
+	for remaining := br.Batch.CurrentSize(); remaining > 0; {
+		maxSize := br.Limits.MaxBatchRecords
+		if remaining < maxSize {
+			maxSize = remaining
+		}
+
+		batch := br.Batch.PopBatch(maxSize, br.Limits.MaxBatchBytes)
+		if len(batch) == 0 {
+			break
+		}
+		remaining -= len(batch)
+
+		if err := br.send(ctx, batch); err != nil {
+			flushErr = err
+		}
+	}
+
+	if len(br.senders) > 0 {
+		if err := br.waitForSenders(); err != nil {
+			flushErr = err
+		}
 	}
+	return flushErr
 }
 
 func (br *batchRunner) Drain() {
@@ -1,12 +1,19 @@
 package historyin
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"code.justin.tv/foundation/history.v2/mocks"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -19,9 +26,11 @@ type BatchRunnerKinesisSuite struct {
 func (s *BatchRunnerKinesisSuite) SetupTest() {
 	s.mockKinesis = new(mocks.KinesisAPI)
 	rs := new(runnerState)
-	processor := &kinesisProcessor{
-		StreamName:  "test-data-stream-name",
-		Kinesis:     s.mockKinesis,
+	processor := &transportProcessor{
+		Transport: &KinesisTransport{
+			StreamName: "test-data-stream-name",
+			Kinesis:    s.mockKinesis,
+		},
 		RunnerState: rs,
 		Logger:      nopLogger{},
 	}
@@ -37,7 +46,7 @@ func (s *BatchRunnerKinesisSuite) TearDownTest() {
 }
 
 func (s *BatchRunnerKinesisSuite) TestRunSingleLoop() {
-	s.Require().NoError(s.batchRunner.Add(&Audit{}))
+	s.Require().NoError(s.batchRunner.Add(testAudit()))
 	s.mockKinesis.
 		On("PutRecordsWithContext", mock.Anything, mock.Anything).
 		Run(func(args mock.Arguments) {
@@ -53,6 +62,312 @@ func (s *BatchRunnerKinesisSuite) TestRunSingleLoop() {
 	s.Assert().True(s.batchRunner.RunnerState.Wait(time.Second))
 }
 
+func (s *BatchRunnerKinesisSuite) TestFlush() {
+	s.batchRunner.MaxBatchAge = time.Hour
+	s.batchRunner.Batch.Threshold = 10
+	s.Require().NoError(s.batchRunner.Add(testAudit()))
+	s.Require().NoError(s.batchRunner.Add(testAudit()))
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			input := args.Get(1).(*kinesis.PutRecordsInput)
+			s.Assert().Len(input.Records, 2)
+		}).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{{}, {}},
+		}, nil).
+		Once()
+
+	go s.batchRunner.Run()
+	defer s.batchRunner.Stop(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Require().NoError(s.batchRunner.Flush(ctx))
+	s.Assert().Equal(0, s.batchRunner.CurrentBatchSize())
+}
+
+func (s *BatchRunnerKinesisSuite) TestFlushUndelivered() {
+	s.batchRunner.MaxBatchAge = time.Hour
+	s.batchRunner.Batch.Threshold = 10
+	s.batchRunner.BatchProcessor.(*transportProcessor).MaxAttempts = 1
+	s.Require().NoError(s.batchRunner.Add(testAudit()))
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{ErrorCode: aws.String("InternalFailure"), ErrorMessage: aws.String("internal failure")},
+			},
+		}, nil).
+		Once()
+
+	go s.batchRunner.Run()
+	defer s.batchRunner.Stop(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Assert().EqualError(s.batchRunner.Flush(ctx), "1 of 1 records not delivered: internal failure")
+}
+
+func (s *BatchRunnerKinesisSuite) TestFlushContextDone() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Assert().Equal(context.Canceled, s.batchRunner.Flush(ctx))
+}
+
+func (s *BatchRunnerKinesisSuite) TestFlushStopped() {
+	go s.batchRunner.Run()
+	s.Require().True(s.batchRunner.Stop(time.Second))
+	s.Assert().Equal(ErrBatcherStopped, s.batchRunner.Flush(context.Background()))
+}
+
+func (s *BatchRunnerKinesisSuite) TestStopDeadLettersQueued() {
+	sink := new(recordingDeadLetterSink)
+	s.batchRunner.BatchProcessor.(*transportProcessor).DeadLetterSink = sink
+	s.batchRunner.Batch.Threshold = 10
+	receipt, err := s.batchRunner.AddWithReceipt(context.Background(), testAudit())
+	s.Require().NoError(err)
+	s.Require().NoError(s.batchRunner.Add(testAudit()))
+
+	// stopped before the queued records are popped
+	s.batchRunner.RunnerState.Stop()
+	s.batchRunner.Run()
+
+	s.Require().Len(sink.letters, 2)
+	s.Assert().Equal(ErrBatcherStopped.Error(), sink.letters[0].ErrorMessage)
+	s.Assert().Equal(0, s.batchRunner.CurrentBatchSize())
+	_, err = receipt.Wait(context.Background())
+	s.Assert().Equal(ErrBatcherStopped, err)
+}
+
+// recordingProcessor records batches, optionally blocking until released
+type recordingProcessor struct {
+	lock    sync.Mutex
+	batches [][]*Record
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (p *recordingProcessor) Process(ctx context.Context, batch []*Record) error {
+	if p.started != nil {
+		p.started <- struct{}{}
+		<-p.release
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.batches = append(p.batches, batch)
+	return p.err
+}
+
+func (p *recordingProcessor) Abandon(batch []*Record) {
+}
+
+func TestBatchRunnerSenders(t *testing.T) {
+	t.Run("keeps partition key order", func(t *testing.T) {
+		processor := &recordingProcessor{}
+		br := &batchRunner{BatchProcessor: processor, Metrics: nopMetrics{}, Senders: 3}
+		br.startSenders()
+
+		for i := 0; i < 10; i++ {
+			var batch []*Record
+			for _, key := range []string{"a", "b", "c", "d"} {
+				batch = append(batch, &Record{PartitionKey: key, Data: []byte(fmt.Sprint(i))})
+			}
+			br.send(context.Background(), batch)
+		}
+		br.stopSenders()
+
+		sent := map[string][]string{}
+		for _, batch := range processor.batches {
+			for _, record := range batch {
+				sent[record.PartitionKey] = append(sent[record.PartitionKey], string(record.Data))
+			}
+		}
+		for _, key := range []string{"a", "b", "c", "d"} {
+			assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, sent[key], key)
+		}
+	})
+
+	t.Run("sends concurrently", func(t *testing.T) {
+		processor := &recordingProcessor{
+			started: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		br := &batchRunner{BatchProcessor: processor, Metrics: nopMetrics{}, Senders: 2}
+		br.startSenders()
+
+		// find keys of different senders
+		keys := map[int]string{}
+		for i := 0; len(keys) < 2; i++ {
+			key := fmt.Sprint(i)
+			keys[senderIndex(&Record{PartitionKey: key}, 2)] = key
+		}
+
+		br.send(context.Background(), []*Record{{PartitionKey: keys[0]}})
+		br.send(context.Background(), []*Record{{PartitionKey: keys[1]}})
+		for i := 0; i < 2; i++ {
+			select {
+			case <-processor.started:
+			case <-time.After(time.Second):
+				t.Fatal("batches should be processed at once")
+			}
+		}
+
+		close(processor.release)
+		br.stopSenders()
+		assert.Len(t, processor.batches, 2)
+	})
+
+	t.Run("flush waits for senders", func(t *testing.T) {
+		processor := &recordingProcessor{}
+		br := &batchRunner{BatchProcessor: processor, Metrics: nopMetrics{}, Senders: 4, MaxInFlight: 1}
+		br.startSenders()
+		defer br.stopSenders()
+
+		var batch []*Record
+		for i := 0; i < 20; i++ {
+			batch = append(batch, &Record{PartitionKey: fmt.Sprint(i)})
+		}
+		require.NoError(t, br.send(context.Background(), batch))
+		require.NoError(t, br.waitForSenders())
+
+		var sent int
+		for _, batch := range processor.batches {
+			sent += len(batch)
+		}
+		assert.Equal(t, 20, sent)
+	})
+
+	t.Run("Flush waits for batches in flight", func(t *testing.T) {
+		processor := &recordingProcessor{
+			started: make(chan struct{}),
+			release: make(chan struct{}),
+			err:     errors.New("1 of 1 records not delivered"),
+		}
+		br := &batchRunner{
+			Batch:          batch{Threshold: 1},
+			BatchProcessor: processor,
+			RunnerState:    new(runnerState),
+			Metrics:        nopMetrics{},
+			MaxBatchAge:    time.Hour,
+			Senders:        2,
+		}
+		go br.Run()
+		defer br.Stop(time.Second)
+
+		require.NoError(t, br.Add(testAudit()))
+		select {
+		case <-processor.started:
+		case <-time.After(time.Second):
+			t.Fatal("batch should be sent")
+		}
+
+		flushed := make(chan error, 1)
+		go func() {
+			flushed <- br.Flush(context.Background())
+		}()
+		select {
+		case <-flushed:
+			t.Fatal("Flush should wait for the slow sender")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(processor.release)
+		select {
+		case err := <-flushed:
+			assert.EqualError(t, err, "1 of 1 records not delivered")
+		case <-time.After(time.Second):
+			t.Fatal("Flush should return once the batch is processed")
+		}
+
+		processor.err = nil
+		assert.NoError(t, br.Flush(context.Background()), "errors are reported once")
+	})
+}
+
+// failingTransport fails every record, counting the batches it is sent
+type failingTransport struct {
+	lock    sync.Mutex
+	batches int
+}
+
+func (t *failingTransport) Put(ctx context.Context, record *Record) error {
+	return errors.New("put failed")
+}
+
+func (t *failingTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.batches++
+
+	results := make([]*RecordResult, len(records))
+	for i := range results {
+		results[i] = &RecordResult{ErrorCode: "InternalFailure"}
+	}
+	return results, nil
+}
+
+func (t *failingTransport) Batches() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.batches
+}
+
+func TestBatchRunnerStop(t *testing.T) {
+	t.Run("wakes every sender", func(t *testing.T) {
+		const senders = 4
+
+		// find a key for each sender
+		var keys []string
+		seen := map[int]bool{}
+		for i := 0; len(keys) < senders; i++ {
+			key := fmt.Sprint(i)
+			if index := senderIndex(&Record{PartitionKey: key}, senders); !seen[index] {
+				seen[index] = true
+				keys = append(keys, key)
+			}
+		}
+		var nKey int
+		partitionKey := func(audit *Audit) (string, string) {
+			nKey++
+			return keys[nKey%senders], ""
+		}
+
+		transport := &failingTransport{}
+		rs := new(runnerState)
+		br := &batchRunner{
+			Batch: batch{Threshold: senders, PartitionKey: partitionKey},
+			BatchProcessor: &transportProcessor{
+				Transport:   transport,
+				RunnerState: rs,
+				Logger:      nopLogger{},
+				RetryPolicy: &ExponentialBackoff{BaseDelay: time.Hour, MaxDelay: time.Hour},
+			},
+			RunnerState: rs,
+			Logger:      nopLogger{},
+			Metrics:     nopMetrics{},
+			MaxBatchAge: time.Hour,
+			Senders:     senders,
+		}
+		go br.Run()
+
+		for i := 0; i < senders; i++ {
+			require.NoError(t, br.Add(testAudit()))
+		}
+		deadline := time.Now().Add(time.Second)
+		for transport.Batches() < senders {
+			if time.Now().After(deadline) {
+				t.Fatal("every sender should be backing off")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		assert.True(t, br.Stop(time.Second), "senders backing off should stop")
+	})
+}
+
 func TestBatchRunner(t *testing.T) {
 	suite.Run(t, &BatchRunnerKinesisSuite{})
 }
@@ -1,13 +1,25 @@
 package historyin
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// testAudit returns a minimal audit that passes validation
+func testAudit() *Audit {
+	return &Audit{
+		Action:       "my-action",
+		UserID:       "my-user-id",
+		ResourceType: "my-resource-type",
+		ResourceID:   "my-resource-id",
+	}
+}
+
 func TestBatch(t *testing.T) {
 	t.Run("Add", func(t *testing.T) {
 		assertNoBreach := func(t *testing.T, b *batch) {
@@ -23,34 +35,41 @@ func TestBatch(t *testing.T) {
 
 		t.Run("success and breach is crossed", func(t *testing.T) {
 			b := batch{}
-			assert.NoError(t, b.Add(&Audit{}))
+			assert.NoError(t, b.Add(testAudit()))
 			<-b.ThresholdBreach()
 			assertNoBreach(t, &b)
 		})
 
 		t.Run("successive calls should not send breach", func(t *testing.T) {
 			b := batch{}
-			assert.NoError(t, b.Add(&Audit{}))
+			assert.NoError(t, b.Add(testAudit()))
 			<-b.ThresholdBreach()
 			assertNoBreach(t, &b)
-			assert.NoError(t, b.Add(&Audit{}))
+			assert.NoError(t, b.Add(testAudit()))
 			assertNoBreach(t, &b)
 		})
 
 		t.Run("MarkThresholdBreachRead should reset breanch", func(t *testing.T) {
 			b := batch{}
-			assert.NoError(t, b.Add(&Audit{}))
+			assert.NoError(t, b.Add(testAudit()))
 			<-b.ThresholdBreach()
 			assertNoBreach(t, &b)
 
 			b.MarkThresholdBreachRead()
 			assertNoBreach(t, &b)
 
-			assert.NoError(t, b.Add(&Audit{}))
+			assert.NoError(t, b.Add(testAudit()))
 			<-b.ThresholdBreach()
 			assertNoBreach(t, &b)
 		})
 
+		t.Run("breach by bytes", func(t *testing.T) {
+			b := batch{Threshold: 10, ThresholdBytes: 1}
+			assert.NoError(t, b.Add(testAudit()))
+			<-b.ThresholdBreach()
+			assert.True(t, b.ThresholdBreached())
+		})
+
 		t.Run("invalid audit", func(t *testing.T) {
 			b := batch{}
 			err := b.Add(&Audit{UUID: "abc"})
@@ -59,46 +78,180 @@ func TestBatch(t *testing.T) {
 			assertNoBreach(t, &b)
 		})
 
-		t.Run("uses UUID as record key", func(t *testing.T) {
+		t.Run("missing required fields", func(t *testing.T) {
 			b := batch{}
 			err := b.Add(&Audit{})
+			require.Error(t, err)
+			assert.IsType(t, &ValidationError{}, err)
+			assert.Equal(t, 0, b.CurrentSize())
+			assertNoBreach(t, &b)
+		})
+
+		t.Run("record too large", func(t *testing.T) {
+			b := batch{MaxRecordBytes: 100}
+			a := testAudit()
+			a.Changes = []ChangeSet{{Attribute: "attr", NewValue: strings.Repeat("a", 100)}}
+
+			err := b.Add(a)
+			require.Error(t, err)
+			require.IsType(t, &RecordTooLargeError{}, err)
+			assert.Equal(t, 100, err.(*RecordTooLargeError).MaxSize)
+			assert.Equal(t, 0, b.CurrentSize())
+			assertNoBreach(t, &b)
+		})
+
+		t.Run("uses UUID as partition key", func(t *testing.T) {
+			b := batch{}
+			err := b.Add(testAudit())
 			require.NoError(t, err)
 			assert.Equal(t, 1, len(b.records))
 			for _, record := range b.records {
-				assert.NotEmpty(t, record.Key)
-				assert.Equal(t, 36, len(record.Key))
+				assert.NotEmpty(t, record.PartitionKey)
+				assert.Equal(t, 36, len(record.PartitionKey))
+			}
+		})
+
+		t.Run("uses partition key func", func(t *testing.T) {
+			b := batch{PartitionKey: PartitionByUser}
+			require.NoError(t, b.Add(testAudit()))
+			assert.Equal(t, "my-user-id", b.records[0].PartitionKey)
+		})
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		t.Run("unbounded by default", func(t *testing.T) {
+			b := batch{}
+			for i := 0; i < 100; i++ {
+				require.NoError(t, b.Add(testAudit()))
+			}
+			assert.Equal(t, 100, b.CurrentSize())
+		})
+
+		t.Run("drop newest", func(t *testing.T) {
+			b := batch{MaxQueueRecords: 2, Overflow: OverflowDropNewest}
+			require.NoError(t, b.Add(testAudit()))
+			require.NoError(t, b.Add(testAudit()))
+			first := b.records[0]
+
+			assert.Equal(t, ErrQueueFull, b.Add(testAudit()))
+			assert.Equal(t, 2, b.CurrentSize())
+			assert.Equal(t, first, b.records[0])
+			assert.Equal(t, uint64(1), b.Dropped())
+		})
+
+		t.Run("drop oldest", func(t *testing.T) {
+			b := batch{MaxQueueRecords: 2, Overflow: OverflowDropOldest}
+			for i := 0; i < 3; i++ {
+				require.NoError(t, b.Add(testAudit()))
 			}
+			second := b.records[1]
+
+			require.NoError(t, b.Add(testAudit()))
+			assert.Equal(t, 2, b.CurrentSize())
+			assert.Equal(t, second, b.records[0])
+			assert.Equal(t, uint64(2), b.Dropped())
+		})
+
+		t.Run("max bytes", func(t *testing.T) {
+			b := batch{Overflow: OverflowDropNewest}
+			require.NoError(t, b.Add(testAudit()))
+			b.MaxQueueBytes = 2*b.records[0].size() + 1
+
+			require.NoError(t, b.Add(testAudit()))
+			assert.Equal(t, ErrQueueFull, b.Add(testAudit()))
+
+			b.PopBatch(1, kinesisBatchMaxBytes)
+			assert.NoError(t, b.Add(testAudit()))
+		})
+
+		t.Run("block until popped", func(t *testing.T) {
+			b := batch{MaxQueueRecords: 1, Threshold: 10}
+			require.NoError(t, b.Add(testAudit()))
+
+			added := make(chan error)
+			go func() {
+				added <- b.Add(testAudit())
+			}()
+
+			<-b.ThresholdBreach()
+			select {
+			case <-added:
+				t.Fatal("add should block while the queue is full")
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			assert.Len(t, b.PopBatch(10, kinesisBatchMaxBytes), 1)
+			assert.NoError(t, <-added)
+			assert.Equal(t, 1, b.CurrentSize())
+			assert.Equal(t, uint64(0), b.Dropped())
+		})
+
+		t.Run("block until context done", func(t *testing.T) {
+			b := batch{MaxQueueRecords: 1}
+			require.NoError(t, b.Add(testAudit()))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			assert.Equal(t, context.DeadlineExceeded, b.AddContext(ctx, testAudit()))
+			assert.Equal(t, 1, b.CurrentSize())
+		})
+
+		t.Run("block until closed", func(t *testing.T) {
+			b := batch{MaxQueueRecords: 1}
+			require.NoError(t, b.Add(testAudit()))
+
+			added := make(chan error)
+			go func() {
+				added <- b.Add(testAudit())
+			}()
+
+			time.Sleep(10 * time.Millisecond)
+			b.Close()
+			assert.Equal(t, ErrBatcherStopped, <-added)
+			assert.Equal(t, ErrBatcherStopped, b.Add(testAudit()), "adds after close should fail")
 		})
 	})
 
 	t.Run("PopBatch", func(t *testing.T) {
 		t.Run("empty", func(t *testing.T) {
 			b := batch{}
-			batch := b.PopBatch(1)
+			batch := b.PopBatch(1, kinesisBatchMaxBytes)
 			assert.Empty(t, batch)
 		})
 
 		t.Run("not multiple", func(t *testing.T) {
 			b := batch{}
 			for i := 0; i < 31; i++ {
-				require.NoError(t, b.Add(&Audit{}))
+				require.NoError(t, b.Add(testAudit()))
 			}
 			for i := 0; i < 3; i++ {
-				assert.Len(t, b.PopBatch(10), 10)
+				assert.Len(t, b.PopBatch(10, kinesisBatchMaxBytes), 10)
+			}
+			assert.Len(t, b.PopBatch(10, kinesisBatchMaxBytes), 1)
+			assert.Len(t, b.PopBatch(10, kinesisBatchMaxBytes), 0)
+		})
+
+		t.Run("cut by bytes", func(t *testing.T) {
+			b := batch{}
+			for i := 0; i < 5; i++ {
+				require.NoError(t, b.Add(testAudit()))
 			}
-			assert.Len(t, b.PopBatch(10), 1)
-			assert.Len(t, b.PopBatch(10), 0)
+			recordBytes := b.records[0].size()
+
+			assert.Len(t, b.PopBatch(10, 2*recordBytes+1), 2)
+			assert.Len(t, b.PopBatch(10, recordBytes-1), 1, "should pop a record over maxBytes alone")
+			assert.Len(t, b.PopBatch(10, 10*recordBytes), 2)
 		})
 
 		t.Run("a multiple", func(t *testing.T) {
 			b := batch{}
 			for i := 0; i < 30; i++ {
-				require.NoError(t, b.Add(&Audit{}))
+				require.NoError(t, b.Add(testAudit()))
 			}
 			for i := 0; i < 3; i++ {
-				assert.Len(t, b.PopBatch(10), 10)
+				assert.Len(t, b.PopBatch(10, kinesisBatchMaxBytes), 10)
 			}
-			assert.Len(t, b.PopBatch(10), 0)
+			assert.Len(t, b.PopBatch(10, kinesisBatchMaxBytes), 0)
 		})
 	})
 }
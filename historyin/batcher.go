@@ -1,8 +1,12 @@
 package historyin
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
-// Batcher batches items to kinesis
+// Batcher batches items to kinesis. Batchers returned by Client also implement
+// ContextAdder, ReceiptAdder, DropCounter and Flusher.
 type Batcher interface {
 	Add(audit *Audit) error
 	Run()
@@ -10,3 +14,30 @@ type Batcher interface {
 	CurrentBatchSize() int
 	Drain()
 }
+
+// ContextAdder is a Batcher that can bound how long Add blocks on a full queue
+type ContextAdder interface {
+	// AddContext is Add with a context bounding how long it blocks on a full
+	// queue
+	AddContext(ctx context.Context, audit *Audit) error
+}
+
+// ReceiptAdder is a Batcher that reports when audits are delivered
+type ReceiptAdder interface {
+	// AddWithReceipt is AddContext returning a receipt resolved once the audit
+	// is delivered or given up on
+	AddWithReceipt(ctx context.Context, audit *Audit) (*Receipt, error)
+}
+
+// DropCounter is a Batcher that counts audits it dropped
+type DropCounter interface {
+	// Dropped returns the number of audits dropped because the queue was full
+	Dropped() uint64
+}
+
+// Flusher is a Batcher that can send everything queued on demand
+type Flusher interface {
+	// Flush sends everything queued and waits until it is acknowledged. It
+	// returns ErrBatcherStopped if the batcher stopped first.
+	Flush(ctx context.Context) error
+}
@@ -0,0 +1,195 @@
+package historyin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	circuitFailureThreshold = 5
+	circuitCooldown         = 30 * time.Second
+)
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+// CircuitStates of CircuitBreaker
+const (
+	// CircuitClosed lets every call through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails calls without sending them until the cooldown ends
+	CircuitOpen
+	// CircuitHalfOpen lets a single trial call through after the cooldown
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitOpenError is returned for calls made while a circuit breaker is open
+type CircuitOpenError struct {
+	// Until is when the breaker lets a trial call through
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker is open until %s", e.Until.Format(time.RFC3339))
+}
+
+// CircuitBreaker stops calls to a transport after consecutive failures. Once
+// Cooldown has passed a single trial call is let through, closing the breaker
+// if it succeeds and opening it again if it fails.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failed calls that opens
+	// the breaker. Defaults to 5.
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open. Defaults to 30s.
+	Cooldown time.Duration
+
+	lock      sync.Mutex
+	state     CircuitState
+	failures  int
+	openUntil time.Time
+	// a trial call is in flight while half-open
+	trial bool
+}
+
+// State returns the current state of the breaker
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.state == CircuitOpen && !time.Now().Before(cb.openUntil) {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// allow returns a *CircuitOpenError if a call should not be made
+func (cb *CircuitBreaker) allow() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Now().Before(cb.openUntil) {
+			return &CircuitOpenError{Until: cb.openUntil}
+		}
+		cb.state = CircuitHalfOpen
+		cb.trial = true
+	case CircuitHalfOpen:
+		if cb.trial {
+			return &CircuitOpenError{Until: cb.openUntil}
+		}
+		cb.trial = true
+	}
+	return nil
+}
+
+// record records the outcome of an allowed call
+func (cb *CircuitBreaker) record(failed bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.trial = false
+	if !failed {
+		cb.state = CircuitClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	threshold := cb.FailureThreshold
+	if threshold <= 0 {
+		threshold = circuitFailureThreshold
+	}
+	if cb.state == CircuitHalfOpen || cb.failures >= threshold {
+		cooldown := cb.Cooldown
+		if cooldown <= 0 {
+			cooldown = circuitCooldown
+		}
+		cb.state = CircuitOpen
+		cb.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// release ends an allowed call without recording its outcome
+func (cb *CircuitBreaker) release() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.trial = false
+}
+
+// breakerTransport guards a transport with a circuit breaker
+type breakerTransport struct {
+	Transport Transport
+	Breaker   *CircuitBreaker
+}
+
+// Put implements Transport
+func (t *breakerTransport) Put(ctx context.Context, record *Record) error {
+	if err := t.Breaker.allow(); err != nil {
+		return err
+	}
+
+	err := t.Transport.Put(ctx, record)
+	t.record(ctx, err != nil)
+	return err
+}
+
+// PutBatch implements Transport. A batch counts as failed if the call fails or
+// every record in it does.
+func (t *breakerTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	if err := t.Breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	results, err := t.Transport.PutBatch(ctx, records)
+	failed := err != nil
+	if !failed && len(results) > 0 {
+		failed = true
+		for _, result := range results {
+			if !result.Failed() {
+				failed = false
+				break
+			}
+		}
+	}
+	t.record(ctx, failed)
+	return results, err
+}
+
+// record records the outcome of a call, ignoring calls cut short by ctx
+func (t *breakerTransport) record(ctx context.Context, failed bool) {
+	if failed && ctx.Err() != nil {
+		t.Breaker.release()
+		return
+	}
+	t.Breaker.record(failed)
+}
+
+// Limits returns the limits of the wrapped transport
+func (t *breakerTransport) Limits() TransportLimits {
+	return transportLimits(t.Transport)
+}
+
+// shards lists the shards of the wrapped transport, bypassing the breaker
+func (t *breakerTransport) shards(ctx context.Context) ([]shardRange, error) {
+	lister, ok := t.Transport.(shardLister)
+	if !ok {
+		return nil, nil
+	}
+	return lister.shards(ctx)
+}
@@ -0,0 +1,98 @@
+package historyin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	myErr := errors.New("my-error")
+
+	t.Run("opens after consecutive failures", func(t *testing.T) {
+		inner := &recordingTransport{err: myErr}
+		breaker := &CircuitBreaker{FailureThreshold: 2, Cooldown: time.Hour}
+		transport := &breakerTransport{Transport: inner, Breaker: breaker}
+
+		assert.Equal(t, myErr, transport.Put(context.Background(), &Record{}))
+		assert.Equal(t, CircuitClosed, breaker.State())
+		assert.Equal(t, myErr, transport.Put(context.Background(), &Record{}))
+		assert.Equal(t, CircuitOpen, breaker.State())
+
+		err := transport.Put(context.Background(), &Record{})
+		require.IsType(t, &CircuitOpenError{}, err)
+		assert.True(t, err.(*CircuitOpenError).Until.After(time.Now()))
+		assert.Len(t, inner.batches, 2, "open breaker should not call the transport")
+	})
+
+	t.Run("success resets failures", func(t *testing.T) {
+		inner := &recordingTransport{err: myErr}
+		breaker := &CircuitBreaker{FailureThreshold: 2}
+		transport := &breakerTransport{Transport: inner, Breaker: breaker}
+
+		transport.Put(context.Background(), &Record{})
+		inner.err = nil
+		require.NoError(t, transport.Put(context.Background(), &Record{}))
+		inner.err = myErr
+		transport.Put(context.Background(), &Record{})
+		assert.Equal(t, CircuitClosed, breaker.State())
+	})
+
+	t.Run("half-open trial", func(t *testing.T) {
+		inner := &recordingTransport{err: myErr}
+		breaker := &CircuitBreaker{FailureThreshold: 1, Cooldown: time.Millisecond}
+		transport := &breakerTransport{Transport: inner, Breaker: breaker}
+
+		transport.Put(context.Background(), &Record{})
+		time.Sleep(2 * time.Millisecond)
+		assert.Equal(t, CircuitHalfOpen, breaker.State())
+
+		assert.Equal(t, myErr, transport.Put(context.Background(), &Record{}), "trial call should be sent")
+		assert.Equal(t, CircuitOpen, breaker.State(), "failed trial should reopen")
+
+		time.Sleep(2 * time.Millisecond)
+		inner.err = nil
+		require.NoError(t, transport.Put(context.Background(), &Record{}))
+		assert.Equal(t, CircuitClosed, breaker.State())
+	})
+
+	t.Run("one trial at a time", func(t *testing.T) {
+		breaker := &CircuitBreaker{FailureThreshold: 1, Cooldown: time.Millisecond}
+		breaker.record(true)
+		time.Sleep(2 * time.Millisecond)
+
+		require.NoError(t, breaker.allow())
+		assert.IsType(t, &CircuitOpenError{}, breaker.allow())
+		breaker.release()
+		assert.NoError(t, breaker.allow())
+	})
+
+	t.Run("batch with every record failed", func(t *testing.T) {
+		inner := &recordingTransport{failKeys: map[string]bool{"a": true}}
+		breaker := &CircuitBreaker{FailureThreshold: 1}
+		transport := &breakerTransport{Transport: inner, Breaker: breaker}
+
+		_, err := transport.PutBatch(context.Background(), []*Record{{PartitionKey: "a"}, {PartitionKey: "b"}})
+		require.NoError(t, err)
+		assert.Equal(t, CircuitClosed, breaker.State())
+
+		_, err = transport.PutBatch(context.Background(), []*Record{{PartitionKey: "a"}})
+		require.NoError(t, err)
+		assert.Equal(t, CircuitOpen, breaker.State())
+	})
+
+	t.Run("ignores canceled calls", func(t *testing.T) {
+		inner := &recordingTransport{err: context.Canceled}
+		breaker := &CircuitBreaker{FailureThreshold: 1}
+		transport := &breakerTransport{Transport: inner, Breaker: breaker}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		transport.Put(ctx, &Record{})
+		assert.Equal(t, CircuitClosed, breaker.State())
+	})
+}
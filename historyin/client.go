@@ -2,17 +2,20 @@ package historyin
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"code.justin.tv/foundation/history.v2/internal/config"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/aws/aws-sdk-go/service/kinesis"
-	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 )
 
 // size when batch will be flushed to firehose
@@ -21,107 +24,527 @@ const flushBatchSize = 250
 // batch age when batch will be flushed to firehose
 const flushBatchAge = time.Minute
 
+// StreamTypes of Client
+const (
+	StreamTypeKinesis  = config.StreamTypeKinesis
+	StreamTypeFirehose = config.StreamTypeFirehose
+)
+
+var (
+	errFirehoseAggregation  = errors.New("firehose does not support aggregation")
+	errKinesisAPIStreamType = errors.New("WithKinesisAPI requires the kinesis stream type")
+	errBatcherName          = errors.New("batcher name must not be a path")
+)
+
 // Client adds history events
 type Client struct {
 	// Environment is the history stack to use. Defaults to production.
-	Environment    string
+	Environment string
+	// StreamType overrides the type of stream of Environment, either
+	// StreamTypeKinesis or StreamTypeFirehose.
+	StreamType string
+	// StreamName overrides the stream name of Environment. This is the delivery
+	// stream name for StreamTypeFirehose.
+	StreamName string
+
+	// FlushBatchSize is how many audits batchers queue before sending them.
+	// Defaults to 250.
 	FlushBatchSize int
-	Logger         Logger
+	// FlushBatchAge is how long batchers hold audits before sending them.
+	// Defaults to a minute.
+	FlushBatchAge time.Duration
+	// MaxBatchBytes caps the size of batches sent by batchers, which send a
+	// batch once this many bytes are queued. Defaults to the transport limit.
+	MaxBatchBytes int
+	// Logger receives warnings and errors. Prefer LeveledLogger.
+	Logger Logger
+	// LeveledLogger receives structured log messages, including retries at
+	// debug level. Defaults to Logger adapted with NewLeveledLogger.
+	LeveledLogger LeveledLogger
+	// Metrics receives measurements of audits sent by the client and its
+	// batchers. Defaults to discarding them.
+	Metrics Metrics
+	// Tracer creates spans for Add, AddBatch and batches sent by batchers.
+	// Defaults to no tracing.
+	Tracer Tracer
+	// CaptureTrace fills the TraceID and SpanID of audits from the Tracer span
+	// in the context they are added with, so consumers can correlate audits
+	// with requests
+	CaptureTrace bool
 
-	initSync sync.Once
+	// SpoolDir, if set, is a directory batchers write audits to before they are
+	// sent so they survive process crashes. Each batcher spools to the
+	// subdirectory of its name, replaying audits left there by a previous
+	// process when it is created. Creating a batcher fails if another batcher
+	// has its subdirectory open.
+	SpoolDir string
+
+	// MaxAttempts is how many times a batcher sends an audit before handing it
+	// to DeadLetterSink. Zero retries until the batcher is stopped.
+	MaxAttempts int
+	// MaxRecordAge is how long a batcher retries an audit before handing it to
+	// DeadLetterSink. Zero retries until the batcher is stopped.
+	MaxRecordAge time.Duration
+	// DeadLetterSink receives audits a batcher gives up on, including audits
+	// still queued when it stops without a SpoolDir. If nil, they are logged
+	// as errors.
+	DeadLetterSink DeadLetterSink
+	// RetryPolicy paces a batcher's retries and decides which failures are
+	// retried rather than dead lettered. Defaults to ExponentialBackoff.
+	RetryPolicy RetryPolicy
+
+	// MaxQueueRecords and MaxQueueBytes bound the audits a batcher holds while
+	// waiting to send them, so an outage does not grow memory without limit.
+	// Zero is unbounded.
+	MaxQueueRecords int
+	MaxQueueBytes   int
+	// OverflowPolicy is what a batcher does with audits added when its queue
+	// is full. Defaults to OverflowBlock.
+	OverflowPolicy OverflowPolicy
+
+	// Senders is how many batches a batcher sends at once, so a slow shard
+	// does not hold up audits for others. Audits with the same partition key
+	// are sent in order by one sender. Defaults to 1. Metrics,
+	// DeadLetterSink and RetryPolicy must be safe for concurrent use if set
+	// higher.
+	Senders int
+	// MaxInFlightBatches caps batches waiting for or being sent by senders.
+	// Defaults to Senders.
+	MaxInFlightBatches int
 
-	streamName string
-	kinesis    kinesisiface.KinesisAPI
+	// Aggregate packs audits sent by batchers into KPL aggregated records to
+	// cut kinesis costs. Consumers must de-aggregate records as the KCL does.
+	// Only kinesis data streams support aggregation. Audits bound for the same
+	// shard are packed together, which needs permission to list the shards
+	// of the stream; without it only audits of the same partition key are.
+	Aggregate bool
+
+	// PartitionKey picks the partition key of audits, such as
+	// PartitionByResource so consumers read the audits of a resource from a
+	// single shard. Defaults to PartitionByUUID.
+	PartitionKey PartitionKeyFunc
+
+	// ServiceName identifies the producer of records in their envelope.
+	// Defaults to the name of the executable.
+	ServiceName string
+
+	// Transport sends audits. Defaults to the stream of Environment.
+	Transport Transport
+
+	// CircuitBreaker, if set, stops sending audits after repeated failures.
+	// While it is open Add and AddBatch fail with a *CircuitOpenError and
+	// batchers hold audits until it lets a trial call through. It may be shared
+	// between clients.
+	CircuitBreaker *CircuitBreaker
+
+	aws      awsOptions
+	initSync sync.Once
 }
 
 func (c *Client) init() (err error) {
 	c.initSync.Do(func() {
-		var cfg config.Config
-		if cfg, err = config.Environment(c.Environment); err != nil {
-			return
+		if c.Transport == nil {
+			if c.Transport, err = c.defaultTransport(); err != nil {
+				return
+			}
 		}
 
-		var kinesisSession *session.Session
-		kinesisSession, err = session.NewSession(&aws.Config{Region: aws.String(cfg.AWSRegion)})
-		if err != nil {
-			return
+		if c.Metrics == nil {
+			c.Metrics = nopMetrics{}
 		}
 
-		kinesisSession, err = session.NewSession(&aws.Config{
-			Region:      aws.String(cfg.AWSRegion),
-			Credentials: stscreds.NewCredentials(kinesisSession, cfg.RoleARN),
-		})
-		if err != nil {
-			return
+		if c.FlushBatchSize == 0 {
+			c.FlushBatchSize = flushBatchSize
+		}
+		if c.FlushBatchAge == 0 {
+			c.FlushBatchAge = flushBatchAge
 		}
 
-		c.streamName = cfg.StreamName
-		c.kinesis = kinesis.New(kinesisSession)
+		err = checkBatchSizes(c.FlushBatchSize, c.MaxBatchBytes)
+	})
 
-		if c.Logger == nil {
-			c.Logger = nopLogger{}
-		}
+	return
+}
 
-		if c.FlushBatchSize == 0 {
-			c.FlushBatchSize = flushBatchSize
+// baseConfig is the config given to WithConfig, or the preset of Environment
+func (c *Client) baseConfig() (config.Config, error) {
+	if c.aws.base != nil {
+		return *c.aws.base, nil
+	}
+	return config.Environment(c.Environment)
+}
+
+// defaultTransport creates the transport for Environment
+func (c *Client) defaultTransport() (Transport, error) {
+	cfg, err := c.baseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.StreamType != "" {
+		cfg.StreamType = c.StreamType
+	}
+	if c.StreamName != "" {
+		cfg.StreamName = c.StreamName
+	}
+
+	if c.aws.region != "" {
+		cfg.AWSRegion = c.aws.region
+	}
+
+	if c.aws.kinesis != nil {
+		if cfg.StreamType != "" && cfg.StreamType != StreamTypeKinesis {
+			return nil, errKinesisAPIStreamType
 		}
+		return &KinesisTransport{
+			StreamName: cfg.StreamName,
+			Kinesis:    c.aws.kinesis,
+		}, nil
+	}
 
-		if c.FlushBatchSize > kinesisBatchMaxRecords {
-			err = fmt.Errorf("FlushBatchSize must be less than %d", c.FlushBatchSize)
-			return
+	awsSession := c.aws.session
+	if awsSession == nil {
+		if awsSession, err = session.NewSession(&aws.Config{
+			Region:      aws.String(cfg.AWSRegion),
+			Credentials: c.aws.credentials,
+		}); err != nil {
+			return nil, err
 		}
-	})
+	}
 
-	return
+	// given credentials are used as is unless a role is given too
+	roleARN := cfg.RoleARN
+	if c.aws.credentials != nil || c.aws.session != nil {
+		roleARN = ""
+	}
+	if c.aws.roleARN != nil {
+		roleARN = *c.aws.roleARN
+	}
+
+	awsConfig := &aws.Config{Region: aws.String(cfg.AWSRegion)}
+	if roleARN != "" {
+		awsConfig.Credentials = stscreds.NewCredentials(awsSession, roleARN)
+	}
+	if c.aws.endpoint != "" {
+		awsConfig.Endpoint = aws.String(c.aws.endpoint)
+	}
+
+	switch cfg.StreamType {
+	case StreamTypeFirehose:
+		return &FirehoseTransport{
+			DeliveryStreamName: cfg.StreamName,
+			Firehose:           firehose.New(awsSession, awsConfig),
+		}, nil
+	case "", StreamTypeKinesis:
+		return &KinesisTransport{
+			StreamName: cfg.StreamName,
+			Kinesis:    kinesis.New(awsSession, awsConfig),
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid history stream type: %s", cfg.StreamType)
 }
 
 // Add submits a new audit to history service
-func (c *Client) Add(ctx context.Context, audit *Audit) error {
+func (c *Client) Add(ctx context.Context, audit *Audit) (err error) {
 	if err := c.init(); err != nil {
 		return err
 	}
 
-	if err := audit.fillOptional(); err != nil {
-		return err
+	if c.CaptureTrace {
+		captureTrace(ctx, c.tracer(), audit)
 	}
 
-	partitionKey := string(audit.UUID)
-	data, err := json.Marshal(audit)
+	ctx, span := c.tracer().Start(ctx, "historyin.Add", SpanOptions{
+		Attributes: transportAttributes(c.Transport),
+	})
+	defer func() { span.End(err) }()
+
+	record, err := newRecord(audit, c.PartitionKey, c.ServiceName)
 	if err != nil {
 		return err
 	}
+	span.SetAttributes(recordsAttributes([]*Record{record})...)
+
+	if err := record.checkSize(transportLimits(c.Transport).MaxRecordBytes); err != nil {
+		return err
+	}
 
-	if _, err := c.kinesis.PutRecordWithContext(ctx, &kinesis.PutRecordInput{
-		Data:         data,
-		PartitionKey: aws.String(partitionKey),
-		StreamName:   aws.String(c.streamName),
-	}); err != nil {
+	if err := c.transport().Put(ctx, record); err != nil {
+		c.Metrics.RecordsFailed(errorCode(err), 1)
 		return err
 	}
 
+	c.Metrics.AuditsAdded(1)
+	c.Metrics.RecordsSent(1)
 	return nil
 }
 
-// Batcher returns a new batcher
+// errorCode returns the aws error code of err, if any
+func errorCode(err error) string {
+	switch e := err.(type) {
+	case *RecordFailedError:
+		return e.ErrorCode
+	case awserr.Error:
+		return e.Code()
+	}
+	return ""
+}
+
+func (c *Client) logger() LeveledLogger {
+	switch {
+	case c.LeveledLogger != nil:
+		return c.LeveledLogger
+	case c.Logger != nil:
+		return NewLeveledLogger(c.Logger)
+	}
+	return nopLogger{}
+}
+
+func (c *Client) tracer() Tracer {
+	if c.Tracer == nil {
+		return nopTracer{}
+	}
+	return c.Tracer
+}
+
+// transport returns Transport guarded by CircuitBreaker if set
+func (c *Client) transport() Transport {
+	if c.CircuitBreaker == nil {
+		return c.Transport
+	}
+	return &breakerTransport{Transport: c.Transport, Breaker: c.CircuitBreaker}
+}
+
+// AddResult is the result of adding an audit with AddBatch
+type AddResult struct {
+	// Err is nil if the audit was sent
+	Err error
+}
+
+// AddBatch synchronously submits audits to history service, returning a result
+// for each audit in the same order. Invalid audits are not sent. Audits are
+// sent in as few calls as the transport limits allow. An error is returned
+// only if the client could not be initialized.
+func (c *Client) AddBatch(ctx context.Context, audits []*Audit) ([]*AddResult, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	ctx, span := c.tracer().Start(ctx, "historyin.AddBatch", SpanOptions{
+		Attributes: transportAttributes(c.Transport),
+	})
+	defer span.End(nil)
+
+	transport := c.transport()
+	limits := transportLimits(transport)
+	results := make([]*AddResult, len(audits))
+	records := make([]*Record, 0, len(audits))
+	// index of the audit of each record
+	auditIndexes := make([]int, 0, len(audits))
+	for nAudit, audit := range audits {
+		results[nAudit] = &AddResult{}
+
+		if c.CaptureTrace {
+			captureTrace(ctx, c.tracer(), audit)
+		}
+
+		record, err := newRecord(audit, c.PartitionKey, c.ServiceName)
+		if err == nil {
+			err = record.checkSize(limits.MaxRecordBytes)
+		}
+		if err != nil {
+			results[nAudit].Err = err
+			continue
+		}
+
+		records = append(records, record)
+		auditIndexes = append(auditIndexes, nAudit)
+	}
+
+	span.SetAttributes(recordsAttributes(records)...)
+
+	for len(records) > 0 {
+		size := chunkSize(records, limits)
+		chunk := records[:size]
+
+		chunkResults, err := transport.PutBatch(ctx, chunk)
+		if err == nil && len(chunkResults) != len(chunk) {
+			err = errInvalidPutBatchResponse
+		}
+
+		for nRecord := range chunk {
+			result := results[auditIndexes[nRecord]]
+			switch {
+			case err != nil:
+				result.Err = err
+			case chunkResults[nRecord].Failed():
+				result.Err = &RecordFailedError{
+					ErrorCode:    chunkResults[nRecord].ErrorCode,
+					ErrorMessage: chunkResults[nRecord].ErrorMessage,
+				}
+			default:
+				c.Metrics.AuditsAdded(1)
+				c.Metrics.RecordsSent(1)
+				continue
+			}
+			c.Metrics.RecordsFailed(errorCode(result.Err), 1)
+		}
+
+		records = records[size:]
+		auditIndexes = auditIndexes[size:]
+	}
+
+	var nFailed int
+	for _, result := range results {
+		if result.Err != nil {
+			nFailed++
+		}
+	}
+	span.SetAttributes(Attribute{Key: attrFailedRecords, Value: nFailed})
+
+	return results, nil
+}
+
+// chunkSize returns how many of records fit in a single batch within limits.
+// A batch always has at least one record.
+func chunkSize(records []*Record, limits TransportLimits) int {
+	size := 0
+	var batchBytes int
+	for size < len(records) && size < limits.MaxBatchRecords {
+		recordBytes := records[size].size()
+		if size > 0 && batchBytes+recordBytes > limits.MaxBatchBytes {
+			break
+		}
+		batchBytes += recordBytes
+		size++
+	}
+	return size
+}
+
+// checkBatchSizes validates FlushBatchSize and MaxBatchBytes
+func checkBatchSizes(flushBatchSize, maxBatchBytes int) error {
+	if flushBatchSize < 0 || flushBatchSize > kinesisBatchMaxRecords {
+		return fmt.Errorf("FlushBatchSize must be at most %d", kinesisBatchMaxRecords)
+	}
+	if maxBatchBytes < 0 {
+		return errors.New("MaxBatchBytes must not be negative")
+	}
+	return nil
+}
+
+// BatcherOptions tune a batcher. Zero fields default to those of the Client,
+// so call sites can tune batchers independently, such as larger batches for
+// high volume audits and a shorter age for latency sensitive ones.
+type BatcherOptions struct {
+	// Name identifies the batcher in metrics and names its subdirectory of
+	// SpoolDir. Batchers sharing Metrics or SpoolDir should have distinct
+	// names. Defaults to the stream name.
+	Name string
+
+	FlushBatchSize int
+	FlushBatchAge  time.Duration
+	MaxBatchBytes  int
+}
+
+// Batcher returns a new batcher. Besides Batcher it implements ContextAdder,
+// ReceiptAdder, DropCounter and Flusher, which callers type assert for:
+//
+//	b, err := client.Batcher()
+//	...
+//	err = b.(historyin.Flusher).Flush(ctx)
 func (c *Client) Batcher() (Batcher, error) {
+	return c.BatcherWithOptions(BatcherOptions{})
+}
+
+// BatcherWithOptions returns a new batcher tuned by opts. It implements the
+// same interfaces as the batchers returned by Batcher.
+func (c *Client) BatcherWithOptions(opts BatcherOptions) (Batcher, error) {
 	if err := c.init(); err != nil {
 		return nil, err
 	}
 
+	if opts.FlushBatchSize == 0 {
+		opts.FlushBatchSize = c.FlushBatchSize
+	}
+	if opts.FlushBatchAge == 0 {
+		opts.FlushBatchAge = c.FlushBatchAge
+	}
+	if opts.MaxBatchBytes == 0 {
+		opts.MaxBatchBytes = c.MaxBatchBytes
+	}
+	if err := checkBatchSizes(opts.FlushBatchSize, opts.MaxBatchBytes); err != nil {
+		return nil, err
+	}
+
+	transport := c.transport()
+	if opts.Name == "" {
+		opts.Name = transportStreamName(transport)
+	}
+	if c.Aggregate {
+		if _, ok := c.Transport.(*FirehoseTransport); ok {
+			return nil, errFirehoseAggregation
+		}
+		transport = &aggregatingTransport{Transport: transport, Logger: c.logger()}
+	}
+
+	var sp *spool
+	var replayed []*Record
+	if c.SpoolDir != "" {
+		if opts.Name == "." || opts.Name == ".." || strings.ContainsAny(opts.Name, `/\`) {
+			return nil, errBatcherName
+		}
+
+		var err error
+		if sp, replayed, err = openSpool(filepath.Join(c.SpoolDir, opts.Name), c.logger()); err != nil {
+			return nil, err
+		}
+	}
+
 	rs := new(runnerState)
-	processor := &kinesisProcessor{
-		StreamName:  c.streamName,
-		Kinesis:     c.kinesis,
+	processor := &transportProcessor{
+		Transport:   transport,
 		RunnerState: rs,
-		Logger:      c.Logger,
+		Logger:      c.logger(),
+		Spool:       sp,
+		Metrics:     c.Metrics,
+		Tracer:      c.tracer(),
+
+		MaxAttempts:    c.MaxAttempts,
+		MaxRecordAge:   c.MaxRecordAge,
+		DeadLetterSink: c.DeadLetterSink,
+		RetryPolicy:    c.RetryPolicy,
+	}
+
+	limits := transportLimits(transport)
+	if opts.MaxBatchBytes != 0 && opts.MaxBatchBytes < limits.MaxBatchBytes {
+		limits.MaxBatchBytes = opts.MaxBatchBytes
 	}
 
 	return &batchRunner{
 		Batch: batch{
-			Threshold: flushBatchSize,
+			Name:           opts.Name,
+			Threshold:      opts.FlushBatchSize,
+			ThresholdBytes: opts.MaxBatchBytes,
+			MaxRecordBytes: limits.MaxRecordBytes,
+			Spool:          sp,
+			records:        replayed,
+			Metrics:        c.Metrics,
+			Tracer:         c.tracer(),
+			CaptureTrace:   c.CaptureTrace,
+			PartitionKey:   c.PartitionKey,
+			ServiceName:    c.ServiceName,
+
+			MaxQueueRecords: c.MaxQueueRecords,
+			MaxQueueBytes:   c.MaxQueueBytes,
+			Overflow:        c.OverflowPolicy,
 		},
-		MaxBatchAge:    flushBatchAge,
+		Limits:         limits,
+		Senders:        c.Senders,
+		MaxInFlight:    c.MaxInFlightBatches,
+		MaxBatchAge:    opts.FlushBatchAge,
 		RunnerState:    rs,
 		BatchProcessor: processor,
+		Logger:         c.logger(),
+		Metrics:        c.Metrics,
 	}, nil
 }
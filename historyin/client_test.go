@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"code.justin.tv/foundation/history.v2/mocks"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
@@ -29,8 +33,11 @@ type ClientSuite struct {
 func (s *ClientSuite) SetupTest() {
 	s.mockKinesis = new(mocks.KinesisAPI)
 	s.client = &Client{
-		streamName: s.streamName(),
-		kinesis:    s.mockKinesis,
+		Transport: &KinesisTransport{
+			StreamName: s.streamName(),
+			Kinesis:    s.mockKinesis,
+		},
+		Metrics: nopMetrics{},
 	}
 	s.client.initSync.Do(func() {})
 }
@@ -65,7 +72,7 @@ func (s *ClientSuite) dummyAudit() *Audit {
 }
 
 func (s *ClientSuite) dummyAuditMarshalled() []byte {
-	data, err := json.Marshal(s.dummyAudit())
+	data, err := json.Marshal(newEnvelope(s.dummyAudit(), ""))
 	s.Require().NoError(err)
 	return data
 }
@@ -77,12 +84,32 @@ func (s *ClientSuite) TestValidEnv() {
 			Environment: env,
 		}
 		s.Require().NoError(client.init())
-		s.Assert().NotEmpty(client.streamName)
-		s.Assert().NotEmpty(client.kinesis)
+		s.Require().IsType(&KinesisTransport{}, client.Transport)
+		s.Assert().NotEmpty(client.Transport.(*KinesisTransport).StreamName)
+		s.Assert().NotEmpty(client.Transport.(*KinesisTransport).Kinesis)
 		s.Assert().NotEmpty(client.FlushBatchSize)
 	}
 }
 
+func (s *ClientSuite) TestInitFirehose() {
+	client := &Client{
+		Environment: "staging",
+		StreamType:  StreamTypeFirehose,
+		StreamName:  "my-delivery-stream",
+	}
+	s.Require().NoError(client.init())
+	s.Require().IsType(&FirehoseTransport{}, client.Transport)
+	s.Assert().Equal("my-delivery-stream", client.Transport.(*FirehoseTransport).DeliveryStreamName)
+	s.Assert().NotEmpty(client.Transport.(*FirehoseTransport).Firehose)
+}
+
+func (s *ClientSuite) TestInitInvalidStreamType() {
+	client := &Client{
+		StreamType: "invalid",
+	}
+	s.Assert().Error(client.init())
+}
+
 func (s *ClientSuite) TestInitInvalidEnv() {
 	client := &Client{
 		Environment: "invalid",
@@ -124,21 +151,72 @@ func (s *ClientSuite) TestAddSuccessEmptyUUID() {
 		On("PutRecordWithContext", mock.Anything, mock.Anything).
 		Run(func(args mock.Arguments) {
 			input := args.Get(1).(*kinesis.PutRecordInput)
-			a := new(audit)
-			s.Require().NoError(json.Unmarshal(input.Data, a))
-			s.Assert().NotEmpty(a.UUID)
+			e := new(envelope)
+			s.Require().NoError(json.Unmarshal(input.Data, e))
+			s.Require().NotNil(e.Audit)
+			s.Assert().NotEmpty(e.Audit.UUID)
 		}).
 		Return(nil, nil)
 
 	s.Require().NoError(s.client.Add(context.Background(), dummyAudit))
 }
 
+func (s *ClientSuite) TestAddPartitionKey() {
+	s.client.PartitionKey = PartitionByResource
+	s.mockKinesis.
+		On("PutRecordWithContext", mock.Anything, &kinesis.PutRecordInput{
+			Data:         s.dummyAuditMarshalled(),
+			StreamName:   aws.String(s.streamName()),
+			PartitionKey: aws.String("my-resource-type/my-resource-id"),
+		}).
+		Return(nil, nil)
+
+	s.Require().NoError(s.client.Add(context.Background(), s.dummyAudit()))
+}
+
 func (s *ClientSuite) TestAddUUIDError() {
 	s.Assert().Error(s.client.Add(context.Background(), &Audit{
 		UUID: "bad-uuid",
 	}))
 }
 
+func (s *ClientSuite) TestAddValidationError() {
+	dummyAudit := s.dummyAudit()
+	dummyAudit.ResourceID = ""
+
+	err := s.client.Add(context.Background(), dummyAudit)
+	s.Require().IsType(&ValidationError{}, err)
+	s.Assert().Equal("ResourceID", err.(*ValidationError).Fields[0].Field)
+}
+
+func (s *ClientSuite) TestAddRecordTooLarge() {
+	dummyAudit := s.dummyAudit()
+	dummyAudit.Changes[0].NewValue = strings.Repeat("a", kinesisRecordMaxBytes)
+
+	err := s.client.Add(context.Background(), dummyAudit)
+	s.Require().IsType(&RecordTooLargeError{}, err)
+	s.Assert().Equal(kinesisRecordMaxBytes, err.(*RecordTooLargeError).MaxSize)
+}
+
+func (s *ClientSuite) TestAddCircuitOpen() {
+	s.client.CircuitBreaker = &CircuitBreaker{FailureThreshold: 1, Cooldown: time.Hour}
+	s.mockDummyKinesisPut().
+		Return(nil, errors.New("my-error")).
+		Once()
+
+	s.Assert().Error(s.client.Add(context.Background(), s.dummyAudit()))
+	s.Assert().Equal(CircuitOpen, s.client.CircuitBreaker.State())
+	s.Assert().IsType(&CircuitOpenError{}, s.client.Add(context.Background(), s.dummyAudit()))
+
+	b, err := s.client.Batcher()
+	s.Require().NoError(err)
+	bp := b.(*batchRunner).BatchProcessor.(*transportProcessor)
+	s.Assert().Equal(&breakerTransport{
+		Transport: s.client.Transport,
+		Breaker:   s.client.CircuitBreaker,
+	}, bp.Transport)
+}
+
 func (s *ClientSuite) TestAddAWSError() {
 	myErr := errors.New("my-error")
 	s.mockDummyKinesisPut().
@@ -147,13 +225,205 @@ func (s *ClientSuite) TestAddAWSError() {
 	s.Assert().Equal(myErr, s.client.Add(context.Background(), s.dummyAudit()))
 }
 
+func (s *ClientSuite) TestAddBatch() {
+	invalid := s.dummyAudit()
+	invalid.ResourceID = ""
+	failed := s.dummyAudit()
+	failed.UUID = ""
+
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			input := args.Get(1).(*kinesis.PutRecordsInput)
+			s.Require().Len(input.Records, 2)
+			s.Assert().Equal(string(s.dummyAudit().UUID), aws.StringValue(input.Records[0].PartitionKey))
+		}).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{},
+				{ErrorCode: aws.String("InternalFailure"), ErrorMessage: aws.String("internal failure")},
+			},
+		}, nil).
+		Once()
+
+	results, err := s.client.AddBatch(context.Background(), []*Audit{s.dummyAudit(), invalid, failed})
+	s.Require().NoError(err)
+	s.Require().Len(results, 3)
+	s.Assert().NoError(results[0].Err)
+	s.Assert().IsType(&ValidationError{}, results[1].Err)
+	s.Assert().Equal(&RecordFailedError{
+		ErrorCode:    "InternalFailure",
+		ErrorMessage: "internal failure",
+	}, results[2].Err)
+	s.Assert().NotEmpty(failed.UUID)
+}
+
+func (s *ClientSuite) TestAddBatchChunks() {
+	audits := make([]*Audit, kinesisBatchMaxRecords+1)
+	for nAudit := range audits {
+		audits[nAudit] = testAudit()
+	}
+
+	myErr := errors.New("my-error")
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(func(ctx aws.Context, input *kinesis.PutRecordsInput, opts ...request.Option) *kinesis.PutRecordsOutput {
+			output := &kinesis.PutRecordsOutput{}
+			for range input.Records {
+				output.Records = append(output.Records, &kinesis.PutRecordsResultEntry{})
+			}
+			return output
+		}, nil).
+		Once()
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(nil, myErr).
+		Once()
+
+	results, err := s.client.AddBatch(context.Background(), audits)
+	s.Require().NoError(err)
+	s.Require().Len(results, len(audits))
+	for _, result := range results[:kinesisBatchMaxRecords] {
+		s.Assert().NoError(result.Err)
+	}
+	s.Assert().Equal(myErr, results[kinesisBatchMaxRecords].Err)
+}
+
+func (s *ClientSuite) TestLogger() {
+	s.Assert().Equal(nopLogger{}, s.client.logger())
+
+	logger := &recordingLogger{}
+	s.client.Logger = logger
+	s.Assert().Equal(NewLeveledLogger(logger), s.client.logger())
+
+	leveled := &StdLogger{}
+	s.client.LeveledLogger = leveled
+	s.Assert().Equal(leveled, s.client.logger())
+}
+
 func (s *ClientSuite) TestBatcher() {
 	b, err := s.client.Batcher()
 	s.Assert().NoError(err)
 	batcher := b.(*batchRunner)
-	s.Assert().IsType(&kinesisProcessor{}, batcher.BatchProcessor)
-	bp := batcher.BatchProcessor.(*kinesisProcessor)
+	s.Assert().IsType(&transportProcessor{}, batcher.BatchProcessor)
+	bp := batcher.BatchProcessor.(*transportProcessor)
 	s.Assert().Equal(batcher.RunnerState, bp.RunnerState)
+	s.Assert().Equal(s.client.Transport, bp.Transport)
+	s.Assert().Equal(kinesisLimits, batcher.Limits)
+	s.Assert().Equal(kinesisRecordMaxBytes, batcher.Batch.MaxRecordBytes)
+}
+
+func (s *ClientSuite) TestBatcherQueueLimits() {
+	s.client.MaxQueueRecords = 10
+	s.client.MaxQueueBytes = 1024
+	s.client.OverflowPolicy = OverflowDropOldest
+
+	b, err := s.client.Batcher()
+	s.Require().NoError(err)
+	batcher := b.(*batchRunner)
+	s.Assert().Equal(10, batcher.Batch.MaxQueueRecords)
+	s.Assert().Equal(1024, batcher.Batch.MaxQueueBytes)
+	s.Assert().Equal(OverflowDropOldest, batcher.Batch.Overflow)
+}
+
+func (s *ClientSuite) TestBatcherFlushSettings() {
+	s.client.FlushBatchSize = 20
+	s.client.FlushBatchAge = time.Second
+	s.client.MaxBatchBytes = 1024
+
+	b, err := s.client.Batcher()
+	s.Require().NoError(err)
+	batcher := b.(*batchRunner)
+	s.Assert().Equal(20, batcher.Batch.Threshold)
+	s.Assert().Equal(1024, batcher.Batch.ThresholdBytes)
+	s.Assert().Equal(1024, batcher.Limits.MaxBatchBytes)
+	s.Assert().Equal(time.Second, batcher.MaxBatchAge)
+}
+
+func (s *ClientSuite) TestBatcherWithOptions() {
+	s.client.FlushBatchSize = 20
+	s.client.FlushBatchAge = time.Second
+
+	b, err := s.client.BatcherWithOptions(BatcherOptions{
+		FlushBatchAge: 10 * time.Millisecond,
+	})
+	s.Require().NoError(err)
+	batcher := b.(*batchRunner)
+	s.Assert().Equal(20, batcher.Batch.Threshold)
+	s.Assert().Equal(10*time.Millisecond, batcher.MaxBatchAge)
+	s.Assert().Equal(kinesisBatchMaxBytes, batcher.Limits.MaxBatchBytes)
+	s.Assert().Equal(s.streamName(), batcher.Batch.Name)
+
+	b, err = s.client.BatcherWithOptions(BatcherOptions{Name: "my-batcher"})
+	s.Require().NoError(err)
+	s.Assert().Equal("my-batcher", b.(*batchRunner).Batch.Name)
+
+	_, err = s.client.BatcherWithOptions(BatcherOptions{FlushBatchSize: 501})
+	s.Assert().EqualError(err, "FlushBatchSize must be at most 500")
+}
+
+func (s *ClientSuite) TestBatcherSenders() {
+	s.client.Senders = 4
+	s.client.MaxInFlightBatches = 8
+
+	b, err := s.client.Batcher()
+	s.Require().NoError(err)
+	batcher := b.(*batchRunner)
+	s.Assert().Equal(4, batcher.Senders)
+	s.Assert().Equal(8, batcher.MaxInFlight)
+}
+
+func (s *ClientSuite) TestBatcherAggregate() {
+	s.client.Aggregate = true
+
+	b, err := s.client.Batcher()
+	s.Require().NoError(err)
+	batcher := b.(*batchRunner)
+	bp := batcher.BatchProcessor.(*transportProcessor)
+	s.Require().IsType(&aggregatingTransport{}, bp.Transport)
+	s.Assert().Equal(s.client.Transport, bp.Transport.(*aggregatingTransport).Transport)
+	s.Assert().True(batcher.Limits.MaxBatchBytes < kinesisBatchMaxBytes)
+	s.Assert().True(batcher.Batch.MaxRecordBytes < kinesisRecordMaxBytes)
+}
+
+func (s *ClientSuite) TestBatcherAggregateFirehose() {
+	s.client.Aggregate = true
+	s.client.Transport = &FirehoseTransport{}
+
+	_, err := s.client.Batcher()
+	s.Assert().Equal(errFirehoseAggregation, err)
+}
+
+func (s *ClientSuite) TestBatcherReplaysSpool() {
+	dir, err := ioutil.TempDir("", "historyin-client")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	s.client.LeveledLogger = nopLogger{}
+	s.client.SpoolDir = dir
+
+	b, err := s.client.Batcher()
+	s.Require().NoError(err)
+	s.Require().NoError(b.Add(s.dummyAudit()))
+
+	_, err = s.client.Batcher()
+	s.Assert().Equal(errSpoolLocked, err, "batchers of the same name should not share a spool")
+	other, err := s.client.BatcherWithOptions(BatcherOptions{Name: "other"})
+	s.Require().NoError(err)
+	s.Assert().Zero(other.CurrentBatchSize(), "batchers should only replay their own spool")
+	s.Require().NoError(other.(*batchRunner).Batch.Spool.Close())
+	_, err = s.client.BatcherWithOptions(BatcherOptions{Name: "../other"})
+	s.Assert().Equal(errBatcherName, err)
+
+	s.Require().NoError(b.(*batchRunner).Batch.Spool.Close())
+
+	b, err = s.client.Batcher()
+	s.Require().NoError(err)
+	s.Assert().Equal(1, b.CurrentBatchSize())
+	batcher := b.(*batchRunner)
+	s.Assert().Equal(batcher.Batch.Spool, batcher.BatchProcessor.(*transportProcessor).Spool)
+	s.Assert().Equal(filepath.Join(dir, s.streamName()), batcher.Batch.Spool.Dir)
+	s.Require().NoError(batcher.Batch.Spool.Close())
 }
 
 func TestClient(t *testing.T) {
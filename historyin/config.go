@@ -0,0 +1,318 @@
+package historyin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/internal/config"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// prefix of environment variables read by LoadConfig
+const configEnvPrefix = "HISTORY_"
+
+// Config configures a client from a file or the environment. Empty settings
+// are taken from the built-in preset of Environment.
+type Config struct {
+	// Environment is a built-in history stack, or the name of a stack
+	// described entirely by the other settings. Defaults to production.
+	Environment string
+	StreamType  string
+	StreamName  string
+	Region      string
+	// RoleARN is the role assumed to send audits. Empty assumes the role of
+	// the preset, if any.
+	RoleARN string
+	// DefaultCredentials sends audits with the default credentials rather
+	// than assuming a role. RoleARN must be empty.
+	DefaultCredentials bool
+	// ServiceName identifies the producer of records. Defaults to the name
+	// of the executable.
+	ServiceName string
+
+	FlushBatchSize int
+	FlushBatchAge  time.Duration
+	MaxBatchBytes  int
+
+	MaxAttempts    int
+	MaxRecordAge   time.Duration
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+}
+
+// ConfigError is returned by LoadConfig for an invalid setting
+type ConfigError struct {
+	// Key is the environment variable or file key of the setting
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid history config %s: %s", e.Key, e.Err)
+}
+
+var (
+	errConfigFormat      = errors.New("config file must be .json, .yaml or .yml")
+	errUnknownConfigKey  = errors.New("unknown key")
+	errNegative          = errors.New("must not be negative")
+	errRequired          = errors.New("required for a custom environment")
+	errRetryDelays       = errors.New("must not be less than retry_base_delay")
+	errRoleARNConflict   = errors.New("must be empty with default_credentials")
+	errInvalidStreamType = fmt.Errorf("must be %s or %s", StreamTypeKinesis, StreamTypeFirehose)
+)
+
+// configSources maps settings to the environment variable or file key they
+// were read from
+type configSources map[string]string
+
+// key returns the environment variable or file key name was read from
+func (s configSources) key(name string) string {
+	if source, ok := s[name]; ok {
+		return source
+	}
+	return name
+}
+
+// configKey parses a setting into a Config
+type configKey struct {
+	name string
+	set  func(cfg *Config, value string) error
+}
+
+var configKeys = []configKey{
+	{"environment", setString(func(cfg *Config) *string { return &cfg.Environment })},
+	{"stream_type", setString(func(cfg *Config) *string { return &cfg.StreamType })},
+	{"stream_name", setString(func(cfg *Config) *string { return &cfg.StreamName })},
+	{"region", setString(func(cfg *Config) *string { return &cfg.Region })},
+	{"role_arn", setString(func(cfg *Config) *string { return &cfg.RoleARN })},
+	{"default_credentials", setBool(func(cfg *Config) *bool { return &cfg.DefaultCredentials })},
+	{"service_name", setString(func(cfg *Config) *string { return &cfg.ServiceName })},
+	{"flush_batch_size", setInt(func(cfg *Config) *int { return &cfg.FlushBatchSize })},
+	{"flush_batch_age", setDuration(func(cfg *Config) *time.Duration { return &cfg.FlushBatchAge })},
+	{"max_batch_bytes", setInt(func(cfg *Config) *int { return &cfg.MaxBatchBytes })},
+	{"max_attempts", setInt(func(cfg *Config) *int { return &cfg.MaxAttempts })},
+	{"max_record_age", setDuration(func(cfg *Config) *time.Duration { return &cfg.MaxRecordAge })},
+	{"retry_base_delay", setDuration(func(cfg *Config) *time.Duration { return &cfg.RetryBaseDelay })},
+	{"retry_max_delay", setDuration(func(cfg *Config) *time.Duration { return &cfg.RetryMaxDelay })},
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errNegative
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return errNegative
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+// LoadConfig reads a config from path, if not empty, then HISTORY_*
+// environment variables, which take precedence. Keys are the snake case names
+// of Config fields, such as stream_name in files or HISTORY_STREAM_NAME in the
+// environment. Durations are strings such as "30s". Settings left empty are
+// taken from the built-in preset of the environment.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	sources := configSources{}
+	if path != "" {
+		if err := cfg.loadFile(path, sources); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(sources); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyPreset(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(sources); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string, sources configSources) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// numbers are kept as written rather than float64 so large integers
+		// are not formatted with exponents
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&settings)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &settings)
+	default:
+		return errConfigFormat
+	}
+	if err != nil {
+		return fmt.Errorf("invalid history config file %s: %s", path, err)
+	}
+
+	for name, value := range settings {
+		key, ok := findConfigKey(name)
+		if !ok {
+			return &ConfigError{Key: name, Err: errUnknownConfigKey}
+		}
+		if err := key.set(cfg, fmt.Sprint(value)); err != nil {
+			return &ConfigError{Key: name, Err: err}
+		}
+		sources[key.name] = name
+	}
+	return nil
+}
+
+func (cfg *Config) loadEnv(sources configSources) error {
+	for _, key := range configKeys {
+		name := configEnvPrefix + strings.ToUpper(key.name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := key.set(cfg, value); err != nil {
+			return &ConfigError{Key: name, Err: err}
+		}
+		sources[key.name] = name
+	}
+	return nil
+}
+
+func findConfigKey(name string) (configKey, bool) {
+	for _, key := range configKeys {
+		if key.name == name {
+			return key, true
+		}
+	}
+	return configKey{}, false
+}
+
+// applyPreset fills empty stream settings from the preset of Environment,
+// except RoleARN under DefaultCredentials. A custom environment must set them
+// itself.
+func (cfg *Config) applyPreset() error {
+	preset, err := config.Environment(cfg.Environment)
+	if err != nil {
+		if cfg.StreamName == "" {
+			return &ConfigError{Key: "stream_name", Err: errRequired}
+		}
+		if cfg.Region == "" {
+			return &ConfigError{Key: "region", Err: errRequired}
+		}
+		return nil
+	}
+
+	if cfg.StreamType == "" {
+		cfg.StreamType = preset.StreamType
+	}
+	if cfg.StreamName == "" {
+		cfg.StreamName = preset.StreamName
+	}
+	if cfg.Region == "" {
+		cfg.Region = preset.AWSRegion
+	}
+	if cfg.RoleARN == "" && !cfg.DefaultCredentials {
+		cfg.RoleARN = preset.RoleARN
+	}
+	return nil
+}
+
+// validate checks settings against each other, reporting the key each was
+// read from
+func (cfg *Config) validate(sources configSources) error {
+	switch cfg.StreamType {
+	case "", StreamTypeKinesis, StreamTypeFirehose:
+	default:
+		return &ConfigError{Key: sources.key("stream_type"), Err: errInvalidStreamType}
+	}
+
+	if cfg.DefaultCredentials && cfg.RoleARN != "" {
+		return &ConfigError{Key: sources.key("role_arn"), Err: errRoleARNConflict}
+	}
+
+	if cfg.FlushBatchSize > kinesisBatchMaxRecords {
+		return &ConfigError{
+			Key: sources.key("flush_batch_size"),
+			Err: fmt.Errorf("must not be more than %d", kinesisBatchMaxRecords),
+		}
+	}
+
+	if cfg.RetryMaxDelay != 0 && cfg.RetryMaxDelay < cfg.RetryBaseDelay {
+		return &ConfigError{Key: sources.key("retry_max_delay"), Err: errRetryDelays}
+	}
+	return nil
+}
+
+// WithConfig applies a config from LoadConfig
+func WithConfig(cfg *Config) Option {
+	return func(c *Client) {
+		c.Environment = cfg.Environment
+		c.aws.base = &config.Config{
+			StreamType: cfg.StreamType,
+			StreamName: cfg.StreamName,
+			AWSRegion:  cfg.Region,
+			RoleARN:    cfg.RoleARN,
+		}
+
+		c.ServiceName = cfg.ServiceName
+		c.FlushBatchSize = cfg.FlushBatchSize
+		c.FlushBatchAge = cfg.FlushBatchAge
+		c.MaxBatchBytes = cfg.MaxBatchBytes
+		c.MaxAttempts = cfg.MaxAttempts
+		c.MaxRecordAge = cfg.MaxRecordAge
+		if cfg.RetryBaseDelay != 0 || cfg.RetryMaxDelay != 0 {
+			c.RetryPolicy = &ExponentialBackoff{
+				BaseDelay: cfg.RetryBaseDelay,
+				MaxDelay:  cfg.RetryMaxDelay,
+			}
+		}
+	}
+}
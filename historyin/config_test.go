@@ -0,0 +1,199 @@
+package historyin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	writeFile := func(t *testing.T, name, data string) string {
+		dir, err := ioutil.TempDir("", "historyin-config")
+		require.NoError(t, err)
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+		return path
+	}
+
+	setenv := func(t *testing.T, key, value string) func() {
+		require.NoError(t, os.Setenv(key, value))
+		return func() { os.Unsetenv(key) }
+	}
+
+	t.Run("preset", func(t *testing.T) {
+		cfg, err := LoadConfig("")
+		require.NoError(t, err)
+		assert.Equal(t, StreamTypeKinesis, cfg.StreamType)
+		assert.Equal(t, "history-v3-prod-stream", cfg.StreamName)
+		assert.Equal(t, "us-west-2", cfg.Region)
+		assert.NotEmpty(t, cfg.RoleARN)
+	})
+
+	t.Run("yaml file", func(t *testing.T) {
+		path := writeFile(t, "history.yaml", `
+environment: staging
+stream_name: my-stream
+flush_batch_size: 100
+flush_batch_age: 30s
+max_attempts: 5
+retry_base_delay: 50ms
+retry_max_delay: 5s
+`)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		cfg, err := LoadConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, &Config{
+			Environment:    "staging",
+			StreamType:     StreamTypeKinesis,
+			StreamName:     "my-stream",
+			Region:         "us-west-2",
+			RoleARN:        "arn:aws:iam::005087123760:role/history-v3-staging-ingest",
+			FlushBatchSize: 100,
+			FlushBatchAge:  30 * time.Second,
+			MaxAttempts:    5,
+			RetryBaseDelay: 50 * time.Millisecond,
+			RetryMaxDelay:  5 * time.Second,
+		}, cfg)
+	})
+
+	t.Run("json file", func(t *testing.T) {
+		path := writeFile(t, "history.json", `{"service_name": "my-service", "flush_batch_size": 10, "max_batch_bytes": 1048576, "max_record_age": "1h"}`)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		cfg, err := LoadConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, "my-service", cfg.ServiceName)
+		assert.Equal(t, 10, cfg.FlushBatchSize)
+		assert.Equal(t, 1048576, cfg.MaxBatchBytes)
+		assert.Equal(t, time.Hour, cfg.MaxRecordAge)
+	})
+
+	t.Run("environment overrides file", func(t *testing.T) {
+		path := writeFile(t, "history.yml", "stream_name: from-file\nregion: eu-west-1\n")
+		defer os.RemoveAll(filepath.Dir(path))
+		defer setenv(t, "HISTORY_STREAM_NAME", "from-env")()
+
+		cfg, err := LoadConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, "from-env", cfg.StreamName)
+		assert.Equal(t, "eu-west-1", cfg.Region)
+	})
+
+	t.Run("custom environment", func(t *testing.T) {
+		defer setenv(t, "HISTORY_ENVIRONMENT", "local")()
+		defer setenv(t, "HISTORY_STREAM_NAME", "local-stream")()
+		defer setenv(t, "HISTORY_REGION", "us-east-1")()
+
+		cfg, err := LoadConfig("")
+		require.NoError(t, err)
+		assert.Equal(t, "local-stream", cfg.StreamName)
+		assert.Empty(t, cfg.RoleARN)
+	})
+
+	t.Run("default credentials", func(t *testing.T) {
+		path := writeFile(t, "history.yaml", "default_credentials: true\n")
+		defer os.RemoveAll(filepath.Dir(path))
+
+		cfg, err := LoadConfig(path)
+		require.NoError(t, err)
+		assert.True(t, cfg.DefaultCredentials)
+		assert.Equal(t, "history-v3-prod-stream", cfg.StreamName)
+		assert.Empty(t, cfg.RoleARN)
+	})
+
+	t.Run("default credentials with role", func(t *testing.T) {
+		defer setenv(t, "HISTORY_DEFAULT_CREDENTIALS", "true")()
+		defer setenv(t, "HISTORY_ROLE_ARN", "my-role")()
+
+		_, err := LoadConfig("")
+		assert.Equal(t, &ConfigError{Key: "HISTORY_ROLE_ARN", Err: errRoleARNConflict}, err)
+	})
+
+	t.Run("custom environment without stream", func(t *testing.T) {
+		defer setenv(t, "HISTORY_ENVIRONMENT", "local")()
+
+		_, err := LoadConfig("")
+		assert.Equal(t, &ConfigError{Key: "stream_name", Err: errRequired}, err)
+	})
+
+	t.Run("invalid environment variable", func(t *testing.T) {
+		defer setenv(t, "HISTORY_FLUSH_BATCH_AGE", "soon")()
+
+		_, err := LoadConfig("")
+		require.IsType(t, &ConfigError{}, err)
+		assert.Equal(t, "HISTORY_FLUSH_BATCH_AGE", err.(*ConfigError).Key)
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		defer setenv(t, "HISTORY_MAX_ATTEMPTS", "-1")()
+
+		_, err := LoadConfig("")
+		assert.EqualError(t, err, "invalid history config HISTORY_MAX_ATTEMPTS: must not be negative")
+	})
+
+	t.Run("unknown file key", func(t *testing.T) {
+		path := writeFile(t, "history.yaml", "stream: my-stream\n")
+		defer os.RemoveAll(filepath.Dir(path))
+
+		_, err := LoadConfig(path)
+		assert.Equal(t, &ConfigError{Key: "stream", Err: errUnknownConfigKey}, err)
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		for key, value := range map[string]string{
+			"stream_type":      "sqs",
+			"flush_batch_size": "501",
+			"retry_max_delay":  "1ms",
+		} {
+			path := writeFile(t, "history.yaml", "retry_base_delay: 1s\n"+key+": "+value+"\n")
+			defer os.RemoveAll(filepath.Dir(path))
+
+			_, err := LoadConfig(path)
+			require.IsType(t, &ConfigError{}, err, key)
+			assert.Equal(t, key, err.(*ConfigError).Key)
+		}
+	})
+
+	t.Run("invalid environment values", func(t *testing.T) {
+		path := writeFile(t, "history.yaml", "flush_batch_size: 10\n")
+		defer os.RemoveAll(filepath.Dir(path))
+		defer setenv(t, "HISTORY_FLUSH_BATCH_SIZE", "501")()
+
+		_, err := LoadConfig(path)
+		require.IsType(t, &ConfigError{}, err)
+		assert.Equal(t, "HISTORY_FLUSH_BATCH_SIZE", err.(*ConfigError).Key)
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		path := writeFile(t, "history.toml", "")
+		defer os.RemoveAll(filepath.Dir(path))
+
+		_, err := LoadConfig(path)
+		assert.Equal(t, errConfigFormat, err)
+	})
+}
+
+func TestWithConfig(t *testing.T) {
+	c := NewClient(WithConfig(&Config{
+		Environment:    "local",
+		StreamName:     "local-stream",
+		Region:         "us-east-1",
+		ServiceName:    "my-service",
+		FlushBatchAge:  time.Second,
+		RetryBaseDelay: time.Millisecond,
+	}))
+	require.NoError(t, c.init())
+
+	require.IsType(t, &KinesisTransport{}, c.Transport)
+	assert.Equal(t, "local-stream", c.Transport.(*KinesisTransport).StreamName)
+	assert.Equal(t, "my-service", c.ServiceName)
+	assert.Equal(t, time.Second, c.FlushBatchAge)
+	assert.Equal(t, flushBatchSize, c.FlushBatchSize)
+	assert.Equal(t, &ExponentialBackoff{BaseDelay: time.Millisecond}, c.RetryPolicy)
+}
@@ -0,0 +1,84 @@
+package historyin
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a record that could not be sent to history
+type DeadLetter struct {
+	PartitionKey string
+	// Data is the marshalled audit
+	Data []byte
+	// ErrorCode and ErrorMessage are from the last failed attempt. ErrorCode is
+	// empty if the failure was not from kinesis.
+	ErrorCode    string
+	ErrorMessage string
+	Attempts     int
+	// FirstAttemptAt is when the record was first sent
+	FirstAttemptAt time.Time
+}
+
+// DeadLetterSink receives records the batcher gives up on
+type DeadLetterSink interface {
+	Put(letter *DeadLetter) error
+}
+
+// FileDeadLetterSink appends dead letters to a file as JSON lines
+type FileDeadLetterSink struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+// json serializable dead letter to be written
+type deadLetterLine struct {
+	PartitionKey   string          `json:"partition_key"`
+	Record         json.RawMessage `json:"record,omitempty"`
+	RecordBase64   []byte          `json:"record_base64,omitempty"`
+	ErrorCode      string          `json:"error_code"`
+	ErrorMessage   string          `json:"error_message"`
+	Attempts       int             `json:"attempts"`
+	FirstAttemptAt time.Time       `json:"first_attempt_at"`
+	DeadLetteredAt time.Time       `json:"dead_lettered_at"`
+}
+
+// Put implements DeadLetterSink
+func (s *FileDeadLetterSink) Put(letter *DeadLetter) error {
+	line := deadLetterLine{
+		PartitionKey:   letter.PartitionKey,
+		ErrorCode:      letter.ErrorCode,
+		ErrorMessage:   letter.ErrorMessage,
+		Attempts:       letter.Attempts,
+		FirstAttemptAt: letter.FirstAttemptAt,
+		DeadLetteredAt: time.Now().UTC(),
+	}
+
+	// keep the audit readable when possible
+	if json.Valid(letter.Data) {
+		line.Record = letter.Data
+	} else {
+		line.RecordBase64 = letter.Data
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,70 @@
+package historyin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDeadLetterSink keeps dead letters in memory
+type recordingDeadLetterSink struct {
+	letters []*DeadLetter
+}
+
+func (s *recordingDeadLetterSink) Put(letter *DeadLetter) error {
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "historyin-dead-letter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sink := &FileDeadLetterSink{Path: filepath.Join(dir, "dead-letters.jsonl")}
+	firstAttemptAt := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	require.NoError(t, sink.Put(&DeadLetter{
+		PartitionKey:   "key-json",
+		Data:           []byte(`{"action":"my-action"}`),
+		ErrorCode:      "InternalFailure",
+		ErrorMessage:   "internal failure",
+		Attempts:       3,
+		FirstAttemptAt: firstAttemptAt,
+	}))
+	require.NoError(t, sink.Put(&DeadLetter{
+		PartitionKey: "key-binary",
+		Data:         []byte{0xf3, 0x89},
+	}))
+
+	file, err := os.Open(sink.Path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var lines []deadLetterLine
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line deadLetterLine
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, lines, 2)
+
+	assert.Equal(t, "key-json", lines[0].PartitionKey)
+	assert.JSONEq(t, `{"action":"my-action"}`, string(lines[0].Record))
+	assert.Equal(t, "InternalFailure", lines[0].ErrorCode)
+	assert.Equal(t, "internal failure", lines[0].ErrorMessage)
+	assert.Equal(t, 3, lines[0].Attempts)
+	assert.True(t, firstAttemptAt.Equal(lines[0].FirstAttemptAt))
+	assert.False(t, lines[0].DeadLetteredAt.IsZero())
+
+	assert.Empty(t, lines[1].Record)
+	assert.Equal(t, []byte{0xf3, 0x89}, lines[1].RecordBase64)
+}
@@ -0,0 +1,148 @@
+package historyin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// SchemaVersion is the version of the envelope and audit schema written
+	// by this library. Readers reject records of later versions.
+	SchemaVersion = 1
+	// ContentType is the content type of enveloped audits
+	ContentType = "application/json"
+	// ContentEncoding is the content encoding of enveloped audits
+	ContentEncoding = "identity"
+
+	// Library names this library in the producer of records
+	Library = "history.v2/historyin"
+	// Version is the version of this library
+	Version = "v2"
+)
+
+// Envelope wraps the audit of a record with the schema it was written in and
+// the producer that wrote it. Records are written as envelopes; records
+// written before envelopes are read as envelopes of SchemaVersion 0.
+type Envelope struct {
+	SchemaVersion   int
+	ContentType     string
+	ContentEncoding string
+	Producer        Producer
+	Audit           *Audit
+}
+
+// Producer identifies what wrote a record
+type Producer struct {
+	Library        string `json:"library,omitempty"`
+	LibraryVersion string `json:"library_version,omitempty"`
+	Hostname       string `json:"hostname,omitempty"`
+	Service        string `json:"service,omitempty"`
+}
+
+// UnsupportedSchemaVersionError is returned when reading a record written in
+// a later schema version than this library knows
+type UnsupportedSchemaVersionError struct {
+	SchemaVersion int
+}
+
+func (e *UnsupportedSchemaVersionError) Error() string {
+	return fmt.Sprintf("unsupported audit schema version %d, at most %d is supported", e.SchemaVersion, SchemaVersion)
+}
+
+var errNoEnvelopeAudit = errors.New("envelope has no audit")
+
+var (
+	hostnameOnce sync.Once
+	hostname     string
+)
+
+// newEnvelope wraps an audit as written by service, or the executable if
+// empty
+func newEnvelope(a *Audit, service string) *Envelope {
+	hostnameOnce.Do(func() {
+		hostname, _ = os.Hostname()
+	})
+	if service == "" && len(os.Args) > 0 {
+		service = filepath.Base(os.Args[0])
+	}
+
+	return &Envelope{
+		SchemaVersion:   SchemaVersion,
+		ContentType:     ContentType,
+		ContentEncoding: ContentEncoding,
+		Producer: Producer{
+			Library:        Library,
+			LibraryVersion: Version,
+			Hostname:       hostname,
+			Service:        service,
+		},
+		Audit: a,
+	}
+}
+
+// MarshalJSON implements json.Marshaller
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	raw := envelope{
+		SchemaVersion:   e.SchemaVersion,
+		ContentType:     e.ContentType,
+		ContentEncoding: e.ContentEncoding,
+		Producer:        e.Producer,
+	}
+	if e.Audit != nil {
+		a := e.Audit.toJSON()
+		raw.Audit = &a
+	}
+	return json.Marshal(raw)
+}
+
+// UnmarshalJSON implements json.Unmarshaller. Bare audits written before
+// envelopes are read with a SchemaVersion of 0.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var raw envelope
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if raw.SchemaVersion == 0 {
+		var a audit
+		if err := json.Unmarshal(data, &a); err != nil {
+			return err
+		}
+		*e = Envelope{Audit: new(Audit)}
+		e.Audit.fromJSON(a)
+		return nil
+	}
+
+	if raw.SchemaVersion > SchemaVersion {
+		return &UnsupportedSchemaVersionError{SchemaVersion: raw.SchemaVersion}
+	}
+	if raw.ContentType != ContentType || raw.ContentEncoding != ContentEncoding {
+		return fmt.Errorf("unsupported audit content type %q with encoding %q", raw.ContentType, raw.ContentEncoding)
+	}
+	if raw.Audit == nil {
+		return errNoEnvelopeAudit
+	}
+
+	*e = Envelope{
+		SchemaVersion:   raw.SchemaVersion,
+		ContentType:     raw.ContentType,
+		ContentEncoding: raw.ContentEncoding,
+		Producer:        raw.Producer,
+		Audit:           new(Audit),
+	}
+	e.Audit.fromJSON(*raw.Audit)
+	return nil
+}
+
+// json serializable envelope to be written
+type envelope struct {
+	SchemaVersion   int      `json:"schema_version"`
+	ContentType     string   `json:"content_type"`
+	ContentEncoding string   `json:"content_encoding"`
+	Producer        Producer `json:"producer"`
+	Audit           *audit   `json:"audit"`
+}
@@ -0,0 +1,112 @@
+package historyin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope(t *testing.T) {
+	now := time.Now().UTC()
+	dummyAudit := &Audit{
+		Action:       "my-action",
+		UserType:     "my-user-type",
+		UserID:       "my-user-id",
+		ResourceType: "my-resource-type",
+		ResourceID:   "my-resource-id",
+		Description:  "my-description",
+		CreatedAt:    Time(now),
+		Changes: []ChangeSet{
+			{"cs-attribute", "cs-old-value", "cs-new-value"},
+		},
+		UUID: "uuid--uuid--uuid--uuid--uuid--uuid--",
+		TTL:  Duration(time.Hour),
+	}
+
+	t.Run("records are envelopes", func(t *testing.T) {
+		record, err := newRecord(dummyAudit, nil, "")
+		require.NoError(t, err)
+
+		var e Envelope
+		require.NoError(t, json.Unmarshal(record.Data, &e))
+		hostname, _ := os.Hostname()
+		assert.Equal(t, Envelope{
+			SchemaVersion:   SchemaVersion,
+			ContentType:     ContentType,
+			ContentEncoding: ContentEncoding,
+			Producer: Producer{
+				Library:        Library,
+				LibraryVersion: Version,
+				Hostname:       hostname,
+				Service:        filepath.Base(os.Args[0]),
+			},
+			Audit: dummyAudit,
+		}, e)
+	})
+
+	t.Run("service", func(t *testing.T) {
+		record, err := newRecord(dummyAudit, nil, "my-service")
+		require.NoError(t, err)
+
+		var e Envelope
+		require.NoError(t, json.Unmarshal(record.Data, &e))
+		assert.Equal(t, "my-service", e.Producer.Service)
+		assert.Equal(t, dummyAudit, e.Audit)
+	})
+
+	t.Run("audits marshal bare", func(t *testing.T) {
+		data, err := json.Marshal(dummyAudit)
+		require.NoError(t, err)
+
+		var raw map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &raw))
+		assert.Equal(t, "my-action", raw["action"])
+		assert.NotContains(t, raw, "schema_version")
+		assert.NotContains(t, raw, "producer")
+	})
+
+	t.Run("audits read envelopes", func(t *testing.T) {
+		record, err := newRecord(dummyAudit, nil, "my-service")
+		require.NoError(t, err)
+
+		var a Audit
+		require.NoError(t, json.Unmarshal(record.Data, &a))
+		assert.Equal(t, *dummyAudit, a)
+	})
+
+	t.Run("reads bare audits", func(t *testing.T) {
+		data, err := json.Marshal(dummyAudit)
+		require.NoError(t, err)
+
+		var e Envelope
+		require.NoError(t, json.Unmarshal(data, &e))
+		assert.Equal(t, Envelope{Audit: dummyAudit}, e)
+
+		var a Audit
+		require.NoError(t, json.Unmarshal(data, &a))
+		assert.Equal(t, *dummyAudit, a)
+	})
+
+	t.Run("unsupported schema version", func(t *testing.T) {
+		var a Audit
+		err := json.Unmarshal([]byte(`{"schema_version": 2, "content_type": "application/json", "content_encoding": "identity", "audit": {}}`), &a)
+		assert.Equal(t, &UnsupportedSchemaVersionError{SchemaVersion: 2}, err)
+	})
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		var a Audit
+		err := json.Unmarshal([]byte(`{"schema_version": 1, "content_type": "application/protobuf", "content_encoding": "identity", "audit": {}}`), &a)
+		assert.EqualError(t, err, `unsupported audit content type "application/protobuf" with encoding "identity"`)
+	})
+
+	t.Run("no audit", func(t *testing.T) {
+		var a Audit
+		err := json.Unmarshal([]byte(`{"schema_version": 1, "content_type": "application/json", "content_encoding": "identity"}`), &a)
+		assert.Equal(t, errNoEnvelopeAudit, err)
+	})
+}
@@ -0,0 +1,142 @@
+package historyin
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+)
+
+const (
+	firehoseBatchMaxRecords = 500
+	firehoseBatchMaxBytes   = 4 * 1024 * 1024
+	firehoseRecordMaxBytes  = 1000 * 1024
+
+	// error code of records in a PutRecordBatch call that failed without an
+	// aws error code
+	firehoseErrCodeRequestFailed = "RequestFailed"
+)
+
+// FirehoseTransport sends records to a kinesis data firehose delivery stream.
+// Records are newline delimited so delivered objects are JSON lines. Partition
+// keys are not used by firehose.
+type FirehoseTransport struct {
+	DeliveryStreamName string
+	Firehose           firehoseiface.FirehoseAPI
+}
+
+// Put implements Transport
+func (t *FirehoseTransport) Put(ctx context.Context, record *Record) error {
+	_, err := t.Firehose.PutRecordWithContext(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: aws.String(t.DeliveryStreamName),
+		Record:             t.firehoseRecord(record),
+	})
+	return err
+}
+
+// Limits returns the PutRecordBatch limits
+func (t *FirehoseTransport) Limits() TransportLimits {
+	return TransportLimits{
+		MaxBatchRecords: firehoseBatchMaxRecords,
+		MaxBatchBytes:   firehoseBatchMaxBytes,
+		MaxRecordBytes:  firehoseRecordMaxBytes,
+	}
+}
+
+// PutBatch implements Transport. Batches over the PutRecordBatch limits are
+// sent in multiple calls.
+func (t *FirehoseTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	chunks := t.chunks(records)
+	if len(chunks) == 1 {
+		return t.putRecordBatch(ctx, chunks[0])
+	}
+
+	results := make([]*RecordResult, 0, len(records))
+	var nFailedChunks int
+	var lastErr error
+	for _, chunk := range chunks {
+		chunkResults, err := t.putRecordBatch(ctx, chunk)
+		if err != nil {
+			// report the failed call on each of its records so other chunks
+			// are not resent
+			nFailedChunks++
+			lastErr = err
+			chunkResults = make([]*RecordResult, len(chunk))
+			for nItem := range chunkResults {
+				chunkResults[nItem] = &RecordResult{
+					ErrorCode:    firehoseErrorCode(err),
+					ErrorMessage: err.Error(),
+				}
+			}
+		}
+		results = append(results, chunkResults...)
+	}
+
+	if nFailedChunks == len(chunks) {
+		return nil, lastErr
+	}
+	return results, nil
+}
+
+func (t *FirehoseTransport) putRecordBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	firehoseRecords := make([]*firehose.Record, 0, len(records))
+	for _, record := range records {
+		firehoseRecords = append(firehoseRecords, t.firehoseRecord(record))
+	}
+
+	output, err := t.Firehose.PutRecordBatchWithContext(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(t.DeliveryStreamName),
+		Records:            firehoseRecords,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(output.RequestResponses) != len(records) {
+		return nil, errInvalidPutBatchResponse
+	}
+
+	results := make([]*RecordResult, 0, len(output.RequestResponses))
+	for _, item := range output.RequestResponses {
+		results = append(results, &RecordResult{
+			ErrorCode:    aws.StringValue(item.ErrorCode),
+			ErrorMessage: aws.StringValue(item.ErrorMessage),
+		})
+	}
+
+	return results, nil
+}
+
+// chunks splits records into batches within the PutRecordBatch limits
+func (t *FirehoseTransport) chunks(records []*Record) [][]*Record {
+	var chunks [][]*Record
+	var chunk []*Record
+	var chunkBytes int
+	for _, record := range records {
+		size := len(record.Data) + 1
+		if len(chunk) > 0 && (len(chunk) == firehoseBatchMaxRecords || chunkBytes+size > firehoseBatchMaxBytes) {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			chunkBytes = 0
+		}
+		chunk = append(chunk, record)
+		chunkBytes += size
+	}
+
+	return append(chunks, chunk)
+}
+
+func (t *FirehoseTransport) firehoseRecord(record *Record) *firehose.Record {
+	data := make([]byte, 0, len(record.Data)+1)
+	data = append(data, record.Data...)
+	return &firehose.Record{Data: append(data, '\n')}
+}
+
+func firehoseErrorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() != "" {
+		return awsErr.Code()
+	}
+	return firehoseErrCodeRequestFailed
+}
@@ -0,0 +1,129 @@
+package historyin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFirehose records PutRecordBatch calls and fails the records and calls
+// it is told to
+type fakeFirehose struct {
+	firehoseiface.FirehoseAPI
+
+	batches      []*firehose.PutRecordBatchInput
+	failCalls    map[int]error
+	failRecords  map[string]bool
+	putRecordErr error
+}
+
+func (f *fakeFirehose) PutRecordWithContext(ctx aws.Context, input *firehose.PutRecordInput, opts ...request.Option) (*firehose.PutRecordOutput, error) {
+	return &firehose.PutRecordOutput{}, f.putRecordErr
+}
+
+func (f *fakeFirehose) PutRecordBatchWithContext(ctx aws.Context, input *firehose.PutRecordBatchInput, opts ...request.Option) (*firehose.PutRecordBatchOutput, error) {
+	f.batches = append(f.batches, input)
+	if err := f.failCalls[len(f.batches)-1]; err != nil {
+		return nil, err
+	}
+
+	output := &firehose.PutRecordBatchOutput{}
+	for _, record := range input.Records {
+		response := &firehose.PutRecordBatchResponseEntry{RecordId: aws.String("id")}
+		if f.failRecords[string(record.Data)] {
+			response = &firehose.PutRecordBatchResponseEntry{
+				ErrorCode:    aws.String(firehose.ErrCodeServiceUnavailableException),
+				ErrorMessage: aws.String("slow down"),
+			}
+		}
+		output.RequestResponses = append(output.RequestResponses, response)
+	}
+	return output, nil
+}
+
+func TestFirehoseTransport(t *testing.T) {
+	t.Run("Limits", func(t *testing.T) {
+		limits := transportLimits(&FirehoseTransport{})
+		assert.Equal(t, firehoseBatchMaxBytes, limits.MaxBatchBytes)
+		assert.Equal(t, firehoseRecordMaxBytes, limits.MaxRecordBytes)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		myErr := errors.New("my-error")
+		transport := &FirehoseTransport{
+			DeliveryStreamName: "my-delivery-stream",
+			Firehose:           &fakeFirehose{putRecordErr: myErr},
+		}
+		assert.Equal(t, myErr, transport.Put(context.Background(), &Record{Data: []byte("{}")}))
+	})
+
+	t.Run("PutBatch", func(t *testing.T) {
+		t.Run("newline delimits records", func(t *testing.T) {
+			fake := &fakeFirehose{failRecords: map[string]bool{"failed\n": true}}
+			transport := &FirehoseTransport{DeliveryStreamName: "my-delivery-stream", Firehose: fake}
+
+			results, err := transport.PutBatch(context.Background(), []*Record{
+				{Data: []byte("sent")},
+				{Data: []byte("failed")},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []*RecordResult{
+				{},
+				{ErrorCode: firehose.ErrCodeServiceUnavailableException, ErrorMessage: "slow down"},
+			}, results)
+
+			require.Len(t, fake.batches, 1)
+			assert.Equal(t, "my-delivery-stream", aws.StringValue(fake.batches[0].DeliveryStreamName))
+			assert.Equal(t, []byte("sent\n"), fake.batches[0].Records[0].Data)
+		})
+
+		t.Run("splits at record limit", func(t *testing.T) {
+			fake := &fakeFirehose{}
+			transport := &FirehoseTransport{Firehose: fake}
+
+			records := make([]*Record, firehoseBatchMaxRecords+1)
+			for i := range records {
+				records[i] = &Record{Data: []byte("{}")}
+			}
+
+			results, err := transport.PutBatch(context.Background(), records)
+			require.NoError(t, err)
+			assert.Len(t, results, len(records))
+			require.Len(t, fake.batches, 2)
+			assert.Len(t, fake.batches[0].Records, firehoseBatchMaxRecords)
+			assert.Len(t, fake.batches[1].Records, 1)
+		})
+
+		t.Run("splits at byte limit", func(t *testing.T) {
+			fake := &fakeFirehose{failCalls: map[int]error{1: errors.New("my-error")}}
+			transport := &FirehoseTransport{Firehose: fake}
+
+			data := make([]byte, firehoseBatchMaxBytes/2)
+			records := []*Record{{Data: data}, {Data: data}}
+
+			results, err := transport.PutBatch(context.Background(), records)
+			require.NoError(t, err, "only part of the batch failed")
+			require.Len(t, fake.batches, 2)
+			assert.False(t, results[0].Failed())
+			assert.Equal(t, &RecordResult{
+				ErrorCode:    firehoseErrCodeRequestFailed,
+				ErrorMessage: "my-error",
+			}, results[1])
+		})
+
+		t.Run("call error", func(t *testing.T) {
+			myErr := errors.New("my-error")
+			transport := &FirehoseTransport{Firehose: &fakeFirehose{failCalls: map[int]error{0: myErr}}}
+
+			_, err := transport.PutBatch(context.Background(), []*Record{{Data: []byte("{}")}})
+			assert.Equal(t, myErr, err)
+		})
+	})
+}
@@ -10,3 +10,8 @@ import (
 type API interface {
 	Add(context.Context, *historyin.Audit) error
 }
+
+// BatchAPI adds history events in batches. *historyin.Client implements it.
+type BatchAPI interface {
+	AddBatch(context.Context, []*historyin.Audit) ([]*historyin.AddResult, error)
+}
@@ -0,0 +1,102 @@
+//go:build go1.20
+// +build go1.20
+
+// Package historyinotel traces historyin clients and batchers with
+// OpenTelemetry. OpenTelemetry needs Go 1.20 or later, so the package is
+// skipped by older toolchains.
+package historyinotel
+
+import (
+	"context"
+	"fmt"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "code.justin.tv/foundation/history.v2/historyin"
+
+// Tracer implements historyin.Tracer with an OpenTelemetry tracer provider.
+// Spans are producer spans.
+//
+//	client := &historyin.Client{
+//		Tracer:       historyinotel.NewTracer(otel.GetTracerProvider()),
+//		CaptureTrace: true,
+//	}
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a tracer with spans from provider
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: provider.Tracer(tracerName)}
+}
+
+// SpanContext implements historyin.Tracer
+func (t *Tracer) SpanContext(ctx context.Context) historyin.SpanContext {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return spanContext{sc: sc}
+}
+
+// Start implements historyin.Tracer
+func (t *Tracer) Start(ctx context.Context, name string, opts historyin.SpanOptions) (context.Context, historyin.Span) {
+	var links []trace.Link
+	for _, link := range opts.Links {
+		if sc, ok := link.(spanContext); ok {
+			links = append(links, trace.Link{SpanContext: sc.sc})
+		}
+	}
+
+	ctx, s := t.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes(opts.Attributes)...),
+		trace.WithLinks(links...),
+	)
+	return ctx, span{span: s}
+}
+
+// spanContext is a historyin.SpanContext keeping the full span context for
+// links
+type spanContext struct {
+	sc trace.SpanContext
+}
+
+func (s spanContext) TraceID() string { return s.sc.TraceID().String() }
+func (s spanContext) SpanID() string  { return s.sc.SpanID().String() }
+
+type span struct {
+	span trace.Span
+}
+
+func (s span) SetAttributes(attrs ...historyin.Attribute) {
+	s.span.SetAttributes(attributes(attrs)...)
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+func attributes(attrs []historyin.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		key := attribute.Key(attr.Key)
+		switch v := attr.Value.(type) {
+		case string:
+			kvs = append(kvs, key.String(v))
+		case int:
+			kvs = append(kvs, key.Int(v))
+		default:
+			kvs = append(kvs, key.String(fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
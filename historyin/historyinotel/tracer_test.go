@@ -0,0 +1,142 @@
+//go:build go1.20
+// +build go1.20
+
+package historyinotel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+var _ historyin.Tracer = &Tracer{}
+
+// recordingProvider records the spans its tracers start
+type recordingProvider struct {
+	noop.TracerProvider
+
+	lock   sync.Mutex
+	nSpans byte
+	spans  []*recordingSpan
+}
+
+func (p *recordingProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{provider: p}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+	provider *recordingProvider
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	p := t.provider
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.nSpans++
+	config := trace.NewSpanStartConfig(opts...)
+	parent := trace.SpanContextFromContext(ctx)
+	traceID := parent.TraceID()
+	if !parent.IsValid() {
+		traceID = trace.TraceID{p.nSpans}
+	}
+	span := &recordingSpan{
+		name:       name,
+		parent:     parent,
+		config:     config,
+		attributes: config.Attributes(),
+		sc: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  trace.SpanID{p.nSpans},
+		}),
+	}
+	p.spans = append(p.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	noop.Span
+
+	name       string
+	parent     trace.SpanContext
+	config     trace.SpanConfig
+	sc         trace.SpanContext
+	attributes []attribute.KeyValue
+	errs       []error
+	status     codes.Code
+	ended      bool
+}
+
+func (s *recordingSpan) SpanContext() trace.SpanContext { return s.sc }
+func (s *recordingSpan) IsRecording() bool              { return !s.ended }
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.attributes = append(s.attributes, kv...)
+}
+
+func (s *recordingSpan) RecordError(err error, opts ...trace.EventOption) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordingSpan) SetStatus(code codes.Code, description string) { s.status = code }
+func (s *recordingSpan) End(opts ...trace.SpanEndOption)               { s.ended = true }
+
+func (s *recordingSpan) attribute(key string) attribute.Value {
+	for _, kv := range s.attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracer(t *testing.T) {
+	provider := new(recordingProvider)
+	tracer := NewTracer(provider)
+
+	assert.Nil(t, tracer.SpanContext(context.Background()))
+
+	ctx, first := tracer.Start(context.Background(), "first", historyin.SpanOptions{})
+	first.End(nil)
+	firstContext := tracer.SpanContext(ctx)
+	require.NotNil(t, firstContext)
+	assert.Equal(t, provider.spans[0].sc.TraceID().String(), firstContext.TraceID())
+	assert.Equal(t, provider.spans[0].sc.SpanID().String(), firstContext.SpanID())
+
+	ctx, span := tracer.Start(ctx, "historyin.Process", historyin.SpanOptions{
+		Attributes: []historyin.Attribute{
+			{Key: "messaging.destination.name", Value: "my-stream"},
+			{Key: "historyin.records", Value: 2},
+		},
+		Links: []historyin.SpanContext{firstContext},
+	})
+	span.SetAttributes(historyin.Attribute{Key: "historyin.retries", Value: 1})
+	span.End(errors.New("1 of 2 records not delivered"))
+
+	require.Len(t, provider.spans, 2)
+	recorded := provider.spans[1]
+	assert.Equal(t, "historyin.Process", recorded.name)
+	assert.Equal(t, trace.SpanKindProducer, recorded.config.SpanKind())
+	assert.Equal(t, provider.spans[0].sc, recorded.parent)
+	require.Len(t, recorded.config.Links(), 1)
+	assert.Equal(t, provider.spans[0].sc, recorded.config.Links()[0].SpanContext)
+
+	assert.Equal(t, "my-stream", recorded.attribute("messaging.destination.name").AsString())
+	assert.Equal(t, int64(2), recorded.attribute("historyin.records").AsInt64())
+	assert.Equal(t, int64(1), recorded.attribute("historyin.retries").AsInt64())
+
+	assert.True(t, recorded.ended)
+	assert.Len(t, recorded.errs, 1)
+	assert.Equal(t, codes.Error, recorded.status)
+	assert.Equal(t, codes.Unset, provider.spans[0].status)
+}
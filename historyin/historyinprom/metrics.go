@@ -0,0 +1,173 @@
+// Package historyinprom exports historyin client and batcher metrics to
+// prometheus.
+package historyinprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const subsystem = "historyin"
+
+// Metrics implements historyin.Metrics as a prometheus collector.
+//
+//	metrics := historyinprom.NewMetrics("myservice")
+//	prometheus.MustRegister(metrics)
+//	client := &historyin.Client{Metrics: metrics}
+type Metrics struct {
+	auditsAdded      prometheus.Counter
+	recordsSent      prometheus.Counter
+	recordsFailed    *prometheus.CounterVec
+	recordsRetried   prometheus.Counter
+	recordsThrottled prometheus.Counter
+	auditsDropped    prometheus.Counter
+	batchRecords     prometheus.Histogram
+	batchBytes       prometheus.Histogram
+	flushSeconds     prometheus.Histogram
+	queueDepth       *prometheus.GaugeVec
+}
+
+// NewMetrics creates metrics named namespace_historyin_*
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		auditsAdded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audits_added_total",
+			Help:      "Audits accepted by clients and batchers.",
+		}),
+		recordsSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "records_sent_total",
+			Help:      "Records accepted by the stream.",
+		}),
+		recordsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "records_failed_total",
+			Help:      "Records not accepted by the stream, by error code.",
+		}, []string{"error_code"}),
+		recordsRetried: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "records_retried_total",
+			Help:      "Records resent by batchers.",
+		}),
+		recordsThrottled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "records_throttled_total",
+			Help:      "Records rejected for exceeding stream throughput.",
+		}),
+		auditsDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audits_dropped_total",
+			Help:      "Audits dropped because a batcher queue was full.",
+		}),
+		batchRecords: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "batch_records",
+			Help:      "Records in batches sent by batchers.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		batchBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "batch_bytes",
+			Help:      "Bytes in batches sent by batchers.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+		}),
+		flushSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "batch_flush_seconds",
+			Help:      "Time taken to send batches, including retries.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queue_depth",
+			Help:      "Audits waiting in batchers, by batcher name.",
+		}, []string{"batcher"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.auditsAdded,
+		m.recordsSent,
+		m.recordsFailed,
+		m.recordsRetried,
+		m.recordsThrottled,
+		m.auditsDropped,
+		m.batchRecords,
+		m.batchBytes,
+		m.flushSeconds,
+		m.queueDepth,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// AuditsAdded implements historyin.Metrics
+func (m *Metrics) AuditsAdded(n int) {
+	m.auditsAdded.Add(float64(n))
+}
+
+// RecordsSent implements historyin.Metrics
+func (m *Metrics) RecordsSent(n int) {
+	m.recordsSent.Add(float64(n))
+}
+
+// RecordsFailed implements historyin.Metrics
+func (m *Metrics) RecordsFailed(errorCode string, n int) {
+	m.recordsFailed.WithLabelValues(errorCode).Add(float64(n))
+}
+
+// RecordsRetried implements historyin.Metrics
+func (m *Metrics) RecordsRetried(n int) {
+	m.recordsRetried.Add(float64(n))
+}
+
+// RecordsThrottled implements historyin.Metrics
+func (m *Metrics) RecordsThrottled(n int) {
+	m.recordsThrottled.Add(float64(n))
+}
+
+// AuditsDropped implements historyin.Metrics
+func (m *Metrics) AuditsDropped(n int) {
+	m.auditsDropped.Add(float64(n))
+}
+
+// BatchSent implements historyin.Metrics
+func (m *Metrics) BatchSent(records, bytes int) {
+	m.batchRecords.Observe(float64(records))
+	m.batchBytes.Observe(float64(bytes))
+}
+
+// BatchFlushed implements historyin.Metrics
+func (m *Metrics) BatchFlushed(latency time.Duration) {
+	m.flushSeconds.Observe(latency.Seconds())
+}
+
+// QueueDepth implements historyin.Metrics
+func (m *Metrics) QueueDepth(batcher string, n int) {
+	m.queueDepth.WithLabelValues(batcher).Set(float64(n))
+}
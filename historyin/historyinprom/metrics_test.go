@@ -0,0 +1,63 @@
+package historyinprom
+
+import (
+	"testing"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ historyin.Metrics = &Metrics{}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics("test")
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(metrics))
+
+	metrics.AuditsAdded(3)
+	metrics.RecordsSent(2)
+	metrics.RecordsFailed("InternalFailure", 1)
+	metrics.RecordsRetried(1)
+	metrics.RecordsThrottled(4)
+	metrics.AuditsDropped(5)
+	metrics.BatchSent(2, 2048)
+	metrics.BatchFlushed(time.Second)
+	metrics.QueueDepth("first", 7)
+	metrics.QueueDepth("second", 3)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	byName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+
+	for name, expected := range map[string]float64{
+		"test_historyin_audits_added_total":      3,
+		"test_historyin_records_sent_total":      2,
+		"test_historyin_records_retried_total":   1,
+		"test_historyin_records_throttled_total": 4,
+		"test_historyin_audits_dropped_total":    5,
+	} {
+		require.Contains(t, byName, name)
+		assert.Equal(t, expected, byName[name].GetMetric()[0].GetCounter().GetValue(), name)
+	}
+
+	failed := byName["test_historyin_records_failed_total"].GetMetric()[0]
+	assert.Equal(t, "InternalFailure", failed.GetLabel()[0].GetValue())
+	assert.Equal(t, float64(1), failed.GetCounter().GetValue())
+
+	assert.Equal(t, uint64(1), byName["test_historyin_batch_records"].GetMetric()[0].GetHistogram().GetSampleCount())
+	assert.Equal(t, float64(2048), byName["test_historyin_batch_bytes"].GetMetric()[0].GetHistogram().GetSampleSum())
+	assert.Equal(t, float64(1), byName["test_historyin_batch_flush_seconds"].GetMetric()[0].GetHistogram().GetSampleSum())
+	depths := make(map[string]float64)
+	for _, metric := range byName["test_historyin_queue_depth"].GetMetric() {
+		depths[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"first": 7, "second": 3}, depths)
+}
@@ -0,0 +1,176 @@
+package historyintest
+
+import (
+	"fmt"
+	"strings"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+)
+
+// TestingT is the subset of *testing.T used by assertions
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+	Helper()
+}
+
+// Matcher narrows the audits an assertion matches
+type Matcher struct {
+	description string
+	match       func(audit *historyin.Audit) bool
+}
+
+func (m Matcher) String() string {
+	return m.description
+}
+
+// Matching matches audits for which match returns true. The description is
+// shown when an assertion fails.
+func Matching(description string, match func(audit *historyin.Audit) bool) Matcher {
+	return Matcher{description: description, match: match}
+}
+
+// WithUser matches audits by a user
+func WithUser(userType, userID string) Matcher {
+	return Matching(fmt.Sprintf("user %s/%s", userType, userID), func(audit *historyin.Audit) bool {
+		return audit.UserType == userType && audit.UserID == userID
+	})
+}
+
+// WithResourceType matches audits of a resource type
+func WithResourceType(resourceType string) Matcher {
+	return Matching("resource type "+resourceType, func(audit *historyin.Audit) bool {
+		return audit.ResourceType == resourceType
+	})
+}
+
+// WithChange matches audits with a change of attribute from oldValue to
+// newValue
+func WithChange(attribute, oldValue, newValue string) Matcher {
+	description := fmt.Sprintf("change of %s from %q to %q", attribute, oldValue, newValue)
+	return Matching(description, func(audit *historyin.Audit) bool {
+		for _, change := range audit.Changes {
+			if change == (historyin.ChangeSet{Attribute: attribute, OldValue: oldValue, NewValue: newValue}) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WithChangedAttribute matches audits with a change of attribute to any value
+func WithChangedAttribute(attribute string) Matcher {
+	return Matching("change of "+attribute, func(audit *historyin.Audit) bool {
+		for _, change := range audit.Changes {
+			if change.Attribute == attribute {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WithChanges matches audits with exactly changes, in any order
+func WithChanges(changes ...historyin.ChangeSet) Matcher {
+	return Matching(fmt.Sprintf("changes %v", changes), func(audit *historyin.Audit) bool {
+		if len(audit.Changes) != len(changes) {
+			return false
+		}
+
+		remaining := make(map[historyin.ChangeSet]int)
+		for _, change := range changes {
+			remaining[change]++
+		}
+		for _, change := range audit.Changes {
+			if remaining[change] == 0 {
+				return false
+			}
+			remaining[change]--
+		}
+		return true
+	})
+}
+
+// Find returns the recorded audits of action on resourceID that match every
+// matcher
+func (r *Recorder) Find(action, resourceID string, matchers ...Matcher) []*historyin.Audit {
+	var found []*historyin.Audit
+	for _, audit := range r.Audits() {
+		if audit.Action == action && audit.ResourceID == resourceID && matchAll(audit, matchers) {
+			found = append(found, audit)
+		}
+	}
+	return found
+}
+
+// AssertAudited asserts an audit of action on resourceID that matches every
+// matcher was recorded, returning it, or the latest if there are several
+func (r *Recorder) AssertAudited(t TestingT, action, resourceID string, matchers ...Matcher) *historyin.Audit {
+	t.Helper()
+
+	found := r.Find(action, resourceID, matchers...)
+	if len(found) == 0 {
+		t.Errorf("no audit of %s on %s%s\nrecorded audits:\n%s",
+			action, resourceID, describeMatchers(matchers), r.describeAudits())
+		return nil
+	}
+	return found[len(found)-1]
+}
+
+// AssertNotAudited asserts no audit of action on resourceID that matches
+// every matcher was recorded
+func (r *Recorder) AssertNotAudited(t TestingT, action, resourceID string, matchers ...Matcher) bool {
+	t.Helper()
+
+	if found := r.Find(action, resourceID, matchers...); len(found) > 0 {
+		t.Errorf("unexpected audit of %s on %s%s\nrecorded audits:\n%s",
+			action, resourceID, describeMatchers(matchers), r.describeAudits())
+		return false
+	}
+	return true
+}
+
+// AssertNoAudits asserts no audits were recorded
+func (r *Recorder) AssertNoAudits(t TestingT) bool {
+	t.Helper()
+
+	if len(r.Audits()) > 0 {
+		t.Errorf("unexpected audits:\n%s", r.describeAudits())
+		return false
+	}
+	return true
+}
+
+func matchAll(audit *historyin.Audit, matchers []Matcher) bool {
+	for _, matcher := range matchers {
+		if !matcher.match(audit) {
+			return false
+		}
+	}
+	return true
+}
+
+func describeMatchers(matchers []Matcher) string {
+	if len(matchers) == 0 {
+		return ""
+	}
+
+	descriptions := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		descriptions = append(descriptions, matcher.String())
+	}
+	return " with " + strings.Join(descriptions, ", ")
+}
+
+func (r *Recorder) describeAudits() string {
+	audits := r.Audits()
+	if len(audits) == 0 {
+		return "\t(none)"
+	}
+
+	lines := make([]string, 0, len(audits))
+	for _, audit := range audits {
+		lines = append(lines, fmt.Sprintf("\t%s on %s/%s by %s/%s %v",
+			audit.Action, audit.ResourceType, audit.ResourceID, audit.UserType, audit.UserID, audit.Changes))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,68 @@
+package historyintest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingT records assertion failures
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) Helper() {}
+
+func TestAssertions(t *testing.T) {
+	r := new(Recorder)
+	require.NoError(t, r.Add(context.Background(), testAudit("rename", "my-channel")))
+
+	t.Run("audited", func(t *testing.T) {
+		rt := new(recordingT)
+		audit := r.AssertAudited(rt, "rename", "my-channel",
+			WithUser("user", "my-user-id"),
+			WithResourceType("channel"),
+			WithChange("name", "old-name", "new-name"),
+			WithChangedAttribute("name"),
+			WithChanges(historyin.ChangeSet{Attribute: "name", OldValue: "old-name", NewValue: "new-name"}),
+		)
+		assert.Empty(t, rt.errors)
+		require.NotNil(t, audit)
+		assert.Equal(t, "my-channel", audit.ResourceID)
+	})
+
+	t.Run("not audited", func(t *testing.T) {
+		rt := new(recordingT)
+		assert.Nil(t, r.AssertAudited(rt, "rename", "my-channel", WithChange("name", "old-name", "other")))
+		require.Len(t, rt.errors, 1)
+		assert.Contains(t, rt.errors[0], `no audit of rename on my-channel with change of name from "old-name" to "other"`)
+		assert.Contains(t, rt.errors[0], "rename on channel/my-channel by user/my-user-id")
+
+		assert.True(t, r.AssertNotAudited(rt, "delete", "my-channel"))
+		assert.False(t, r.AssertNotAudited(rt, "rename", "my-channel"))
+		assert.Len(t, rt.errors, 2)
+	})
+
+	t.Run("custom matcher", func(t *testing.T) {
+		rt := new(recordingT)
+		r.AssertAudited(rt, "rename", "my-channel", Matching("no description", func(audit *historyin.Audit) bool {
+			return audit.Description == ""
+		}))
+		assert.Empty(t, rt.errors)
+	})
+
+	t.Run("no audits", func(t *testing.T) {
+		rt := new(recordingT)
+		assert.True(t, new(Recorder).AssertNoAudits(rt))
+		assert.False(t, r.AssertNoAudits(rt))
+		assert.Len(t, rt.errors, 1)
+	})
+}
@@ -0,0 +1,339 @@
+package kinesistest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// default and max records returned by GetRecords
+const maxGetRecords = 10000
+
+// operations of the kinesis API served
+var operations = map[string]func(*Server, *http.Request) (interface{}, *apiError){
+	"PutRecord":        (*Server).putRecord,
+	"PutRecords":       (*Server).putRecords,
+	"ListShards":       (*Server).listShards,
+	"GetShardIterator": (*Server).getShardIterator,
+	"GetRecords":       (*Server).getRecords,
+}
+
+type putRecordInput struct {
+	StreamName      string
+	Data            []byte
+	PartitionKey    string
+	ExplicitHashKey string
+}
+
+type putRecordOutput struct {
+	SequenceNumber string
+	ShardID        string `json:"ShardId"`
+}
+
+func (s *Server) putRecord(r *http.Request) (interface{}, *apiError) {
+	var input putRecordInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, err := s.findStream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{
+		Data:            input.Data,
+		PartitionKey:    input.PartitionKey,
+		ExplicitHashKey: input.ExplicitHashKey,
+	}
+	if err := s.put(st, record); err != nil {
+		return nil, err
+	}
+	return &putRecordOutput{SequenceNumber: record.SequenceNumber, ShardID: record.ShardID}, nil
+}
+
+type putRecordsInput struct {
+	StreamName string
+	Records    []*putRecordInput
+}
+
+type putRecordsResultEntry struct {
+	SequenceNumber string `json:",omitempty"`
+	ShardID        string `json:"ShardId,omitempty"`
+	ErrorCode      string `json:",omitempty"`
+	ErrorMessage   string `json:",omitempty"`
+}
+
+type putRecordsOutput struct {
+	FailedRecordCount int
+	Records           []*putRecordsResultEntry
+}
+
+func (s *Server) putRecords(r *http.Request) (interface{}, *apiError) {
+	var input putRecordsInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, err := s.findStream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &putRecordsOutput{}
+	for _, entry := range input.Records {
+		result := &putRecordsResultEntry{}
+		output.Records = append(output.Records, result)
+
+		if code := s.takeRecordFault(); code != "" {
+			result.ErrorCode = code
+			result.ErrorMessage = "injected failure"
+			output.FailedRecordCount++
+			continue
+		}
+
+		record := &Record{
+			Data:            entry.Data,
+			PartitionKey:    entry.PartitionKey,
+			ExplicitHashKey: entry.ExplicitHashKey,
+		}
+		if err := s.put(st, record); err != nil {
+			result.ErrorCode = err.code
+			result.ErrorMessage = err.message
+			output.FailedRecordCount++
+			continue
+		}
+		result.SequenceNumber = record.SequenceNumber
+		result.ShardID = record.ShardID
+	}
+	return output, nil
+}
+
+type listShardsInput struct {
+	StreamName string
+}
+
+type hashKeyRange struct {
+	StartingHashKey string
+	EndingHashKey   string
+}
+
+type sequenceNumberRange struct {
+	StartingSequenceNumber string
+	EndingSequenceNumber   string `json:",omitempty"`
+}
+
+type shardOutput struct {
+	ShardID             string `json:"ShardId"`
+	ParentShardID       string `json:"ParentShardId,omitempty"`
+	HashKeyRange        hashKeyRange
+	SequenceNumberRange sequenceNumberRange
+}
+
+type listShardsOutput struct {
+	Shards []*shardOutput
+}
+
+func (s *Server) listShards(r *http.Request) (interface{}, *apiError) {
+	var input listShardsInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, err := s.findStream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &listShardsOutput{}
+	for _, sh := range st.shards {
+		out := &shardOutput{
+			ShardID:       sh.id,
+			ParentShardID: sh.parentID,
+			HashKeyRange: hashKeyRange{
+				StartingHashKey: sh.startKey.String(),
+				EndingHashKey:   sh.endKey.String(),
+			},
+			SequenceNumberRange: sequenceNumberRange{StartingSequenceNumber: sh.firstSeqN},
+		}
+		if sh.closed {
+			out.SequenceNumberRange.EndingSequenceNumber = sequenceNumberString(s.sequenceNumber)
+		}
+		output.Shards = append(output.Shards, out)
+	}
+	return output, nil
+}
+
+type getShardIteratorInput struct {
+	StreamName             string
+	ShardID                string `json:"ShardId"`
+	ShardIteratorType      string
+	StartingSequenceNumber string
+}
+
+type getShardIteratorOutput struct {
+	ShardIterator string
+}
+
+func (s *Server) getShardIterator(r *http.Request) (interface{}, *apiError) {
+	var input getShardIteratorInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, err := s.findStream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := st.findShard(input.ShardID)
+	if err != nil {
+		return nil, err
+	}
+
+	var position int
+	switch input.ShardIteratorType {
+	case kinesis.ShardIteratorTypeTrimHorizon:
+	case kinesis.ShardIteratorTypeLatest:
+		position = len(sh.records)
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		position = sort.Search(len(sh.records), func(i int) bool {
+			return sh.records[i].SequenceNumber >= input.StartingSequenceNumber
+		})
+		if input.ShardIteratorType == kinesis.ShardIteratorTypeAfterSequenceNumber &&
+			position < len(sh.records) && sh.records[position].SequenceNumber == input.StartingSequenceNumber {
+			position++
+		}
+	default:
+		return nil, &apiError{
+			code:    kinesis.ErrCodeInvalidArgumentException,
+			message: "unsupported shard iterator type " + input.ShardIteratorType,
+		}
+	}
+	return &getShardIteratorOutput{ShardIterator: encodeIterator(input.StreamName, sh.id, position)}, nil
+}
+
+type getRecordsInput struct {
+	ShardIterator string
+	Limit         int
+}
+
+type recordOutput struct {
+	Data                        []byte
+	PartitionKey                string
+	SequenceNumber              string
+	ApproximateArrivalTimestamp float64
+}
+
+type getRecordsOutput struct {
+	Records            []*recordOutput
+	NextShardIterator  string `json:",omitempty"`
+	MillisBehindLatest int64
+}
+
+func (s *Server) getRecords(r *http.Request) (interface{}, *apiError) {
+	var input getRecordsInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+
+	streamName, shardID, position, ok := decodeIterator(input.ShardIterator)
+	if !ok {
+		return nil, &apiError{code: kinesis.ErrCodeInvalidArgumentException, message: "invalid shard iterator"}
+	}
+	if input.Limit <= 0 || input.Limit > maxGetRecords {
+		input.Limit = maxGetRecords
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, err := s.findStream(streamName)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := st.findShard(shardID)
+	if err != nil {
+		return nil, err
+	}
+
+	if position > len(sh.records) {
+		return nil, &apiError{code: kinesis.ErrCodeInvalidArgumentException, message: "invalid shard iterator"}
+	}
+
+	output := &getRecordsOutput{Records: []*recordOutput{}}
+	for _, record := range sh.records[position:] {
+		if len(output.Records) == input.Limit {
+			break
+		}
+		output.Records = append(output.Records, &recordOutput{
+			Data:                        record.Data,
+			PartitionKey:                record.PartitionKey,
+			SequenceNumber:              record.SequenceNumber,
+			ApproximateArrivalTimestamp: float64(record.ArrivedAt.UnixNano()) / 1e9,
+		})
+	}
+
+	next := position + len(output.Records)
+	// a closed shard read to its end has no next iterator
+	if !sh.closed || next < len(sh.records) {
+		output.NextShardIterator = encodeIterator(streamName, shardID, next)
+	}
+	return output, nil
+}
+
+func (st *stream) findShard(id string) (*shard, *apiError) {
+	for _, sh := range st.shards {
+		if sh.id == id {
+			return sh, nil
+		}
+	}
+	return nil, &apiError{
+		code:    kinesis.ErrCodeResourceNotFoundException,
+		message: fmt.Sprintf("Shard %s not found", id),
+	}
+}
+
+func encodeIterator(streamName, shardID string, position int) string {
+	iterator := strings.Join([]string{streamName, shardID, strconv.Itoa(position)}, "/")
+	return base64.StdEncoding.EncodeToString([]byte(iterator))
+}
+
+func decodeIterator(iterator string) (streamName, shardID string, position int, ok bool) {
+	data, err := base64.StdEncoding.DecodeString(iterator)
+	if err != nil {
+		return "", "", 0, false
+	}
+	parts := strings.Split(string(data), "/")
+	if len(parts) != 3 {
+		return "", "", 0, false
+	}
+	position, err = strconv.Atoi(parts[2])
+	if err != nil || position < 0 {
+		return "", "", 0, false
+	}
+	return parts[0], parts[1], position, true
+}
+
+// sortRecords sorts records by sequence number, the order they arrived in
+func sortRecords(records []*Record) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].SequenceNumber < records[j].SequenceNumber
+	})
+}
@@ -0,0 +1,315 @@
+// Package kinesistest provides an in-process stand-in for kinesis data streams
+// serving the subset of the kinesis API used by historyin clients and
+// consumers, with fault injection to test retries and shutdown.
+//
+//	srv := kinesistest.NewServer()
+//	defer srv.Close()
+//	srv.CreateStream("my-stream", 2)
+//	srv.FailRecords(1, kinesis.ErrCodeProvisionedThroughputExceededException)
+//
+//	client := historyin.NewClient(
+//		historyin.WithKinesisAPI(srv.Kinesis()),
+//		historyin.WithStreamName("my-stream"),
+//	)
+package kinesistest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/internal/kpl"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// prefix of the X-Amz-Target header of kinesis operations
+const targetPrefix = "Kinesis_20131202."
+
+// maxHashKey is the end of the hash key range of a stream, 2^128 - 1
+var maxHashKey = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+
+// Record is a record stored by the server
+type Record struct {
+	Data            []byte
+	PartitionKey    string
+	ExplicitHashKey string
+	SequenceNumber  string
+	ShardID         string
+	ArrivedAt       time.Time
+}
+
+// Server is an in-process kinesis data streams server. Streams must be
+// created before use.
+type Server struct {
+	*httptest.Server
+
+	lock           sync.Mutex
+	streams        map[string]*stream
+	sequenceNumber uint64
+
+	latency     time.Duration
+	failCalls   int
+	callCode    string
+	failRecords int
+	recordCode  string
+}
+
+type stream struct {
+	shards []*shard
+}
+
+type shard struct {
+	id        string
+	startKey  *big.Int
+	endKey    *big.Int
+	parentID  string
+	closed    bool
+	records   []*Record
+	firstSeqN string
+}
+
+// NewServer starts a server. It must be closed when done.
+func NewServer() *Server {
+	s := &Server{streams: make(map[string]*stream)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Kinesis returns a client of the server. It does not retry failed calls so
+// the retries of the code under test can be observed.
+func (s *Server) Kinesis() *kinesis.Kinesis {
+	return kinesis.New(session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(s.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+}
+
+// CreateStream creates a stream with shards splitting the hash key range
+// evenly
+func (s *Server) CreateStream(name string, shards int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := &stream{}
+	width := new(big.Int).Div(new(big.Int).Add(maxHashKey, big.NewInt(1)), big.NewInt(int64(shards)))
+	for i := 0; i < shards; i++ {
+		start := new(big.Int).Mul(width, big.NewInt(int64(i)))
+		end := new(big.Int).Sub(new(big.Int).Add(start, width), big.NewInt(1))
+		if i == shards-1 {
+			end = maxHashKey
+		}
+		st.shards = append(st.shards, s.newShard(st, start, end, ""))
+	}
+	s.streams[name] = st
+}
+
+// SplitShard closes a shard of a stream, replacing it with two children
+// splitting its hash key range in half, as kinesis resharding does
+func (s *Server) SplitShard(name, shardID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.streams[name]
+	if !ok {
+		return fmt.Errorf("stream %s not found", name)
+	}
+	for _, sh := range st.shards {
+		if sh.id != shardID || sh.closed {
+			continue
+		}
+
+		sh.closed = true
+		middle := new(big.Int).Rsh(new(big.Int).Add(sh.startKey, sh.endKey), 1)
+		st.shards = append(st.shards,
+			s.newShard(st, sh.startKey, middle, sh.id),
+			s.newShard(st, new(big.Int).Add(middle, big.NewInt(1)), sh.endKey, sh.id),
+		)
+		return nil
+	}
+	return fmt.Errorf("open shard %s not found", shardID)
+}
+
+func (s *Server) newShard(st *stream, start, end *big.Int, parentID string) *shard {
+	return &shard{
+		id:        fmt.Sprintf("shardId-%012d", len(st.shards)),
+		startKey:  start,
+		endKey:    end,
+		parentID:  parentID,
+		firstSeqN: s.nextSequenceNumber(),
+	}
+}
+
+// Records returns the records stored in a stream in the order they arrived
+func (s *Server) Records(name string) []*Record {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var records []*Record
+	st, ok := s.streams[name]
+	if !ok {
+		return nil
+	}
+	for _, sh := range st.shards {
+		records = append(records, sh.records...)
+	}
+	sortRecords(records)
+	return records
+}
+
+// SetLatency delays every call
+func (s *Server) SetLatency(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.latency = latency
+}
+
+// FailCalls fails the next n calls with errorCode, such as InternalFailure
+// or kinesis.ErrCodeProvisionedThroughputExceededException
+func (s *Server) FailCalls(n int, errorCode string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failCalls = n
+	s.callCode = errorCode
+}
+
+// FailRecords fails the next n records of PutRecords calls with errorCode,
+// such as InternalFailure or
+// kinesis.ErrCodeProvisionedThroughputExceededException, while the rest of
+// their calls succeed
+func (s *Server) FailRecords(n int, errorCode string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failRecords = n
+	s.recordCode = errorCode
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), targetPrefix)
+	handler, ok := operations[operation]
+	if !ok {
+		writeError(w, "UnknownOperationException", "unsupported operation "+operation)
+		return
+	}
+
+	s.lock.Lock()
+	latency := s.latency
+	var callCode string
+	if s.failCalls > 0 {
+		s.failCalls--
+		callCode = s.callCode
+	}
+	s.lock.Unlock()
+
+	time.Sleep(latency)
+	if callCode != "" {
+		writeError(w, callCode, "injected failure")
+		return
+	}
+
+	output, err := handler(s, r)
+	if err != nil {
+		writeError(w, err.code, err.message)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(output)
+}
+
+// apiError is a kinesis error response
+type apiError struct {
+	code    string
+	message string
+}
+
+func writeError(w http.ResponseWriter, code, message string) {
+	status := http.StatusBadRequest
+	if code == "InternalFailure" || code == "ServiceUnavailable" {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"__type":  code,
+		"message": message,
+	})
+}
+
+func decode(r *http.Request, input interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+		return &apiError{code: "SerializationException", message: err.Error()}
+	}
+	return nil
+}
+
+// findStream returns a stream. The lock must be held.
+func (s *Server) findStream(name string) (*stream, *apiError) {
+	st, ok := s.streams[name]
+	if !ok {
+		return nil, &apiError{
+			code:    kinesis.ErrCodeResourceNotFoundException,
+			message: fmt.Sprintf("Stream %s not found", name),
+		}
+	}
+	return st, nil
+}
+
+// put stores a record in the open shard of its hash key. The lock must be
+// held.
+func (s *Server) put(st *stream, record *Record) *apiError {
+	hashKey := record.ExplicitHashKey
+	if hashKey == "" {
+		hashKey = kpl.ExplicitHashKey(record.PartitionKey)
+	}
+	key, ok := new(big.Int).SetString(hashKey, 10)
+	if !ok || key.Sign() < 0 || key.Cmp(maxHashKey) > 0 {
+		return &apiError{code: kinesis.ErrCodeInvalidArgumentException, message: "invalid explicit hash key"}
+	}
+
+	for _, sh := range st.shards {
+		if !sh.closed && key.Cmp(sh.startKey) >= 0 && key.Cmp(sh.endKey) <= 0 {
+			record.ShardID = sh.id
+			record.SequenceNumber = s.nextSequenceNumber()
+			record.ArrivedAt = time.Now()
+			sh.records = append(sh.records, record)
+			return nil
+		}
+	}
+	return &apiError{code: "InternalFailure", message: "no shard for hash key"}
+}
+
+// nextSequenceNumber returns increasing sequence numbers. The lock must be
+// held.
+func (s *Server) nextSequenceNumber() string {
+	s.sequenceNumber++
+	return sequenceNumberString(s.sequenceNumber)
+}
+
+// sequenceNumberString pads sequence numbers so they sort as strings
+func sequenceNumberString(n uint64) string {
+	return fmt.Sprintf("%020d", n)
+}
+
+// takeRecordFault returns the error code of the next record to fail, if any.
+// The lock must be held.
+func (s *Server) takeRecordFault() string {
+	if s.failRecords == 0 {
+		return ""
+	}
+	s.failRecords--
+	return s.recordCode
+}
@@ -0,0 +1,286 @@
+package kinesistest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const streamName = "my-stream"
+
+func newServer(t *testing.T, shards int) *Server {
+	srv := NewServer()
+	srv.CreateStream(streamName, shards)
+	return srv
+}
+
+func readShard(t *testing.T, client *kinesis.Kinesis, shardID string) []*kinesis.Record {
+	iterator, err := client.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(streamName),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	})
+	require.NoError(t, err)
+
+	output, err := client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator.ShardIterator})
+	require.NoError(t, err)
+	return output.Records
+}
+
+func TestServer(t *testing.T) {
+	t.Run("put and get", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+		client := srv.Kinesis()
+
+		put, err := client.PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(streamName),
+			PartitionKey: aws.String("a"),
+			Data:         []byte("first"),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "shardId-000000000000", aws.StringValue(put.ShardId))
+
+		_, err = client.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(streamName),
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{PartitionKey: aws.String("b"), Data: []byte("second")},
+			},
+		})
+		require.NoError(t, err)
+
+		records := readShard(t, client, aws.StringValue(put.ShardId))
+		require.Len(t, records, 2)
+		assert.Equal(t, []byte("first"), records[0].Data)
+		assert.Equal(t, aws.StringValue(put.SequenceNumber), aws.StringValue(records[0].SequenceNumber))
+		assert.Equal(t, []byte("second"), records[1].Data)
+		assert.WithinDuration(t, time.Now(), aws.TimeValue(records[1].ApproximateArrivalTimestamp), time.Minute)
+		assert.Len(t, srv.Records(streamName), 2)
+	})
+
+	t.Run("iterators", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+		client := srv.Kinesis()
+
+		var sequenceNumbers []string
+		for _, data := range []string{"a", "b", "c"} {
+			put, err := client.PutRecord(&kinesis.PutRecordInput{
+				StreamName:   aws.String(streamName),
+				PartitionKey: aws.String("key"),
+				Data:         []byte(data),
+			})
+			require.NoError(t, err)
+			sequenceNumbers = append(sequenceNumbers, aws.StringValue(put.SequenceNumber))
+		}
+
+		iterator, err := client.GetShardIterator(&kinesis.GetShardIteratorInput{
+			StreamName:             aws.String(streamName),
+			ShardId:                aws.String("shardId-000000000000"),
+			ShardIteratorType:      aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber),
+			StartingSequenceNumber: aws.String(sequenceNumbers[0]),
+		})
+		require.NoError(t, err)
+
+		output, err := client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator.ShardIterator, Limit: aws.Int64(1)})
+		require.NoError(t, err)
+		require.Len(t, output.Records, 1)
+		assert.Equal(t, []byte("b"), output.Records[0].Data)
+
+		output, err = client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: output.NextShardIterator})
+		require.NoError(t, err)
+		require.Len(t, output.Records, 1)
+		assert.Equal(t, []byte("c"), output.Records[0].Data)
+	})
+
+	t.Run("shards by hash key", func(t *testing.T) {
+		srv := newServer(t, 2)
+		defer srv.Close()
+		client := srv.Kinesis()
+
+		shards, err := client.ListShards(&kinesis.ListShardsInput{StreamName: aws.String(streamName)})
+		require.NoError(t, err)
+		require.Len(t, shards.Shards, 2)
+
+		for _, shard := range shards.Shards {
+			put, err := client.PutRecord(&kinesis.PutRecordInput{
+				StreamName:      aws.String(streamName),
+				PartitionKey:    aws.String("key"),
+				ExplicitHashKey: shard.HashKeyRange.EndingHashKey,
+				Data:            []byte("{}"),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, aws.StringValue(shard.ShardId), aws.StringValue(put.ShardId))
+		}
+	})
+
+	t.Run("split shard", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+		client := srv.Kinesis()
+
+		require.NoError(t, srv.SplitShard(streamName, "shardId-000000000000"))
+		shards, err := client.ListShards(&kinesis.ListShardsInput{StreamName: aws.String(streamName)})
+		require.NoError(t, err)
+		require.Len(t, shards.Shards, 3)
+		assert.NotNil(t, shards.Shards[0].SequenceNumberRange.EndingSequenceNumber)
+		assert.Equal(t, "shardId-000000000000", aws.StringValue(shards.Shards[1].ParentShardId))
+		assert.Equal(t, "shardId-000000000000", aws.StringValue(shards.Shards[2].ParentShardId))
+
+		iterator, err := client.GetShardIterator(&kinesis.GetShardIteratorInput{
+			StreamName:        aws.String(streamName),
+			ShardId:           aws.String("shardId-000000000000"),
+			ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+		})
+		require.NoError(t, err)
+		output, err := client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator.ShardIterator})
+		require.NoError(t, err)
+		assert.Nil(t, output.NextShardIterator, "closed shard read to its end")
+	})
+
+	t.Run("unknown stream", func(t *testing.T) {
+		srv := NewServer()
+		defer srv.Close()
+
+		_, err := srv.Kinesis().PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String("unknown"),
+			PartitionKey: aws.String("a"),
+			Data:         []byte("{}"),
+		})
+		require.Implements(t, (*awserr.Error)(nil), err)
+		assert.Equal(t, kinesis.ErrCodeResourceNotFoundException, err.(awserr.Error).Code())
+	})
+
+	t.Run("fail calls", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+		client := srv.Kinesis()
+		srv.FailCalls(1, "InternalFailure")
+
+		input := &kinesis.PutRecordInput{
+			StreamName:   aws.String(streamName),
+			PartitionKey: aws.String("a"),
+			Data:         []byte("{}"),
+		}
+		_, err := client.PutRecord(input)
+		require.Error(t, err)
+		assert.Equal(t, "InternalFailure", err.(awserr.Error).Code())
+
+		_, err = client.PutRecord(input)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail records", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+		srv.FailRecords(1, kinesis.ErrCodeProvisionedThroughputExceededException)
+
+		output, err := srv.Kinesis().PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(streamName),
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{PartitionKey: aws.String("a"), Data: []byte("failed")},
+				{PartitionKey: aws.String("b"), Data: []byte("sent")},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), aws.Int64Value(output.FailedRecordCount))
+		assert.Equal(t, kinesis.ErrCodeProvisionedThroughputExceededException, aws.StringValue(output.Records[0].ErrorCode))
+		assert.NotEmpty(t, aws.StringValue(output.Records[1].SequenceNumber))
+
+		records := srv.Records(streamName)
+		require.Len(t, records, 1)
+		assert.Equal(t, []byte("sent"), records[0].Data)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+		srv.SetLatency(20 * time.Millisecond)
+
+		start := time.Now()
+		_, err := srv.Kinesis().ListShards(&kinesis.ListShardsInput{StreamName: aws.String(streamName)})
+		require.NoError(t, err)
+		assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	})
+}
+
+func TestClient(t *testing.T) {
+	audit := func(resourceID string) *historyin.Audit {
+		return &historyin.Audit{
+			Action:       "my-action",
+			UserID:       "my-user-id",
+			ResourceType: "my-resource-type",
+			ResourceID:   resourceID,
+		}
+	}
+
+	decode := func(t *testing.T, records []*Record) []string {
+		var resourceIDs []string
+		for _, record := range records {
+			a := new(historyin.Audit)
+			require.NoError(t, json.Unmarshal(record.Data, a))
+			resourceIDs = append(resourceIDs, a.ResourceID)
+		}
+		return resourceIDs
+	}
+
+	t.Run("add", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+
+		client := historyin.NewClient(historyin.WithKinesisAPI(srv.Kinesis()), historyin.WithStreamName(streamName))
+		require.NoError(t, client.Add(context.Background(), audit("a")))
+		assert.Equal(t, []string{"a"}, decode(t, srv.Records(streamName)))
+	})
+
+	t.Run("batcher retries", func(t *testing.T) {
+		srv := newServer(t, 2)
+		defer srv.Close()
+		srv.FailCalls(1, "InternalFailure")
+		srv.FailRecords(2, kinesis.ErrCodeProvisionedThroughputExceededException)
+
+		client := historyin.NewClient(historyin.WithKinesisAPI(srv.Kinesis()), historyin.WithStreamName(streamName))
+		client.RetryPolicy = &historyin.ExponentialBackoff{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+		batcher, err := client.BatcherWithOptions(historyin.BatcherOptions{FlushBatchSize: 10, FlushBatchAge: time.Hour})
+		require.NoError(t, err)
+		go batcher.Run()
+		defer batcher.Stop(time.Second)
+
+		for _, resourceID := range []string{"a", "b", "c"} {
+			require.NoError(t, batcher.Add(audit(resourceID)))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, batcher.(historyin.Flusher).Flush(ctx))
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, decode(t, srv.Records(streamName)))
+	})
+
+	t.Run("batcher stops while failing", func(t *testing.T) {
+		srv := newServer(t, 1)
+		defer srv.Close()
+		srv.FailCalls(1000, kinesis.ErrCodeProvisionedThroughputExceededException)
+
+		client := historyin.NewClient(historyin.WithKinesisAPI(srv.Kinesis()), historyin.WithStreamName(streamName))
+		client.RetryPolicy = &historyin.ExponentialBackoff{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+		batcher, err := client.Batcher()
+		require.NoError(t, err)
+		go batcher.Run()
+
+		receipt, err := batcher.(historyin.ReceiptAdder).AddWithReceipt(context.Background(), audit("a"))
+		require.NoError(t, err)
+
+		assert.True(t, batcher.Stop(5*time.Second))
+		_, err = receipt.Wait(context.Background())
+		assert.Error(t, err)
+		assert.Empty(t, srv.Records(streamName))
+	})
+}
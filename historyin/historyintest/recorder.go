@@ -0,0 +1,198 @@
+// Package historyintest provides fakes of historyin clients and batchers that
+// record audits, and assertions on them, for tests of code that adds audits.
+//
+//	recorder := new(historyintest.Recorder)
+//	service := NewService(recorder)
+//	service.RenameChannel(ctx, "my-channel", "new-name")
+//	recorder.AssertAudited(t, "rename_channel", "my-channel",
+//		historyintest.WithChange("name", "old-name", "new-name"))
+package historyintest
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"code.justin.tv/foundation/history.v2/historyin/historyiniface"
+)
+
+var (
+	_ historyiniface.API      = (*Recorder)(nil)
+	_ historyiniface.BatchAPI = (*Recorder)(nil)
+	_ historyin.Batcher       = (*Batcher)(nil)
+	_ historyin.ContextAdder  = (*Batcher)(nil)
+	_ historyin.ReceiptAdder  = (*Batcher)(nil)
+	_ historyin.DropCounter   = (*Batcher)(nil)
+	_ historyin.Flusher       = (*Batcher)(nil)
+)
+
+// Recorder implements historyiniface.API and BatchAPI, recording audits as consumers of
+// the stream would decode them. Audits are filled and validated as by a real
+// client, so invalid audits fail to be added. The zero value is ready to use.
+type Recorder struct {
+	// Err, if set, is returned instead of recording audits
+	Err error
+
+	initSync sync.Once
+	client   *historyin.Client
+
+	lock   sync.Mutex
+	audits []*historyin.Audit
+}
+
+func (r *Recorder) init() {
+	r.initSync.Do(func() {
+		r.client = &historyin.Client{Transport: &transport{recorder: r}}
+	})
+}
+
+// Add implements historyiniface.API
+func (r *Recorder) Add(ctx context.Context, audit *historyin.Audit) error {
+	r.init()
+
+	if err := r.err(); err != nil {
+		return err
+	}
+	return r.client.Add(ctx, audit)
+}
+
+// AddBatch implements historyiniface.BatchAPI
+func (r *Recorder) AddBatch(ctx context.Context, audits []*historyin.Audit) ([]*historyin.AddResult, error) {
+	r.init()
+
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	return r.client.AddBatch(ctx, audits)
+}
+
+// Batcher returns a batcher that records audits as soon as they are added
+func (r *Recorder) Batcher() *Batcher {
+	return &Batcher{recorder: r}
+}
+
+// Audits returns the recorded audits in the order they were added
+func (r *Recorder) Audits() []*historyin.Audit {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	audits := make([]*historyin.Audit, len(r.audits))
+	copy(audits, r.audits)
+	return audits
+}
+
+// Reset forgets the recorded audits
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.audits = nil
+}
+
+func (r *Recorder) err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.Err
+}
+
+// record decodes records into audits, returning the number recorded so far
+func (r *Recorder) record(records ...*historyin.Record) (int, error) {
+	audits := make([]*historyin.Audit, 0, len(records))
+	for _, record := range records {
+		audit := new(historyin.Audit)
+		if err := json.Unmarshal(record.Data, audit); err != nil {
+			return 0, err
+		}
+		audits = append(audits, audit)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.audits = append(r.audits, audits...)
+	return len(r.audits), nil
+}
+
+// transport records the records sent by the client of a recorder
+type transport struct {
+	recorder *Recorder
+}
+
+func (t *transport) Put(ctx context.Context, record *historyin.Record) error {
+	_, err := t.recorder.record(record)
+	return err
+}
+
+func (t *transport) PutBatch(ctx context.Context, records []*historyin.Record) ([]*historyin.RecordResult, error) {
+	n, err := t.recorder.record(records...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*historyin.RecordResult, len(records))
+	for i := range results {
+		results[i] = &historyin.RecordResult{
+			SequenceNumber: strconv.Itoa(n - len(records) + i + 1),
+		}
+	}
+	return results, nil
+}
+
+// Batcher implements historyin.Batcher and its optional interfaces, recording
+// audits of a Recorder as soon as they are added rather than in batches
+type Batcher struct {
+	recorder *Recorder
+}
+
+// Add implements historyin.Batcher
+func (b *Batcher) Add(audit *historyin.Audit) error {
+	return b.recorder.Add(context.Background(), audit)
+}
+
+// AddContext implements historyin.ContextAdder
+func (b *Batcher) AddContext(ctx context.Context, audit *historyin.Audit) error {
+	return b.recorder.Add(ctx, audit)
+}
+
+// AddWithReceipt implements historyin.ReceiptAdder. The receipt is resolved when
+// it is returned.
+func (b *Batcher) AddWithReceipt(ctx context.Context, audit *historyin.Audit) (*historyin.Receipt, error) {
+	if err := b.recorder.Add(ctx, audit); err != nil {
+		return nil, err
+	}
+
+	b.recorder.lock.Lock()
+	sequenceNumber := strconv.Itoa(len(b.recorder.audits))
+	b.recorder.lock.Unlock()
+	return historyin.NewResolvedReceipt(&historyin.Delivery{SequenceNumber: sequenceNumber}, nil), nil
+}
+
+// Run implements historyin.Batcher. It returns immediately.
+func (b *Batcher) Run() {}
+
+// Stop implements historyin.Batcher
+func (b *Batcher) Stop(timeout time.Duration) bool {
+	return true
+}
+
+// CurrentBatchSize implements historyin.Batcher. It is always zero.
+func (b *Batcher) CurrentBatchSize() int {
+	return 0
+}
+
+// Dropped implements historyin.DropCounter. It is always zero.
+func (b *Batcher) Dropped() uint64 {
+	return 0
+}
+
+// Drain implements historyin.Batcher
+func (b *Batcher) Drain() {}
+
+// Flush implements historyin.Flusher
+func (b *Batcher) Flush(ctx context.Context) error {
+	return nil
+}
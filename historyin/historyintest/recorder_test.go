@@ -0,0 +1,93 @@
+package historyintest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAudit(action, resourceID string) *historyin.Audit {
+	return &historyin.Audit{
+		Action:       action,
+		UserType:     "user",
+		UserID:       "my-user-id",
+		ResourceType: "channel",
+		ResourceID:   resourceID,
+		Changes: []historyin.ChangeSet{
+			{Attribute: "name", OldValue: "old-name", NewValue: "new-name"},
+		},
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	t.Run("add", func(t *testing.T) {
+		r := new(Recorder)
+		require.NoError(t, r.Add(context.Background(), testAudit("rename", "my-channel")))
+
+		audits := r.Audits()
+		require.Len(t, audits, 1)
+		assert.Equal(t, "rename", audits[0].Action)
+		assert.NotEmpty(t, audits[0].UUID, "optional attributes should be filled")
+		assert.False(t, time.Time(audits[0].CreatedAt).IsZero())
+	})
+
+	t.Run("add invalid", func(t *testing.T) {
+		r := new(Recorder)
+		err := r.Add(context.Background(), &historyin.Audit{})
+		assert.IsType(t, &historyin.ValidationError{}, err)
+		assert.Empty(t, r.Audits())
+	})
+
+	t.Run("add batch", func(t *testing.T) {
+		r := new(Recorder)
+		results, err := r.AddBatch(context.Background(), []*historyin.Audit{
+			testAudit("rename", "a"),
+			{},
+			testAudit("rename", "b"),
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.NoError(t, results[0].Err)
+		assert.Error(t, results[1].Err)
+		assert.NoError(t, results[2].Err)
+		assert.Len(t, r.Audits(), 2)
+	})
+
+	t.Run("err", func(t *testing.T) {
+		myErr := errors.New("my-error")
+		r := &Recorder{Err: myErr}
+		assert.Equal(t, myErr, r.Add(context.Background(), testAudit("rename", "a")))
+		_, err := r.AddBatch(context.Background(), []*historyin.Audit{testAudit("rename", "a")})
+		assert.Equal(t, myErr, err)
+		assert.Empty(t, r.Audits())
+	})
+
+	t.Run("batcher", func(t *testing.T) {
+		r := new(Recorder)
+		b := r.Batcher()
+		go b.Run()
+		defer b.Stop(0)
+
+		require.NoError(t, b.Add(testAudit("rename", "a")))
+		receipt, err := b.AddWithReceipt(context.Background(), testAudit("rename", "b"))
+		require.NoError(t, err)
+
+		delivery, err := receipt.Wait(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "2", delivery.SequenceNumber)
+		assert.NoError(t, b.Flush(context.Background()))
+		assert.Len(t, r.Audits(), 2)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		r := new(Recorder)
+		require.NoError(t, r.Add(context.Background(), testAudit("rename", "a")))
+		r.Reset()
+		assert.Empty(t, r.Audits())
+	})
+}
@@ -0,0 +1,116 @@
+package historyin
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+const (
+	kinesisBatchMaxRecords = 500
+	kinesisBatchMaxBytes   = 5 * 1024 * 1024
+	kinesisRecordMaxBytes  = 1024 * 1024
+)
+
+var kinesisLimits = TransportLimits{
+	MaxBatchRecords: kinesisBatchMaxRecords,
+	MaxBatchBytes:   kinesisBatchMaxBytes,
+	MaxRecordBytes:  kinesisRecordMaxBytes,
+}
+
+// KinesisTransport sends records to a kinesis data stream
+type KinesisTransport struct {
+	StreamName string
+	Kinesis    kinesisiface.KinesisAPI
+}
+
+// Put implements Transport
+func (t *KinesisTransport) Put(ctx context.Context, record *Record) error {
+	_, err := t.Kinesis.PutRecordWithContext(ctx, &kinesis.PutRecordInput{
+		Data:            record.Data,
+		PartitionKey:    aws.String(record.PartitionKey),
+		ExplicitHashKey: explicitHashKey(record),
+		StreamName:      aws.String(t.StreamName),
+	})
+	return err
+}
+
+// Limits returns the PutRecords limits
+func (t *KinesisTransport) Limits() TransportLimits {
+	return kinesisLimits
+}
+
+// PutBatch implements Transport
+func (t *KinesisTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	entries := make([]*kinesis.PutRecordsRequestEntry, 0, len(records))
+	for _, record := range records {
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{
+			Data:            record.Data,
+			PartitionKey:    aws.String(record.PartitionKey),
+			ExplicitHashKey: explicitHashKey(record),
+		})
+	}
+
+	output, err := t.Kinesis.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{
+		StreamName: aws.String(t.StreamName),
+		Records:    entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(output.Records) != len(records) {
+		return nil, errInvalidPutBatchResponse
+	}
+
+	results := make([]*RecordResult, 0, len(output.Records))
+	for _, item := range output.Records {
+		results = append(results, &RecordResult{
+			ErrorCode:      aws.StringValue(item.ErrorCode),
+			ErrorMessage:   aws.StringValue(item.ErrorMessage),
+			SequenceNumber: aws.StringValue(item.SequenceNumber),
+			ShardID:        aws.StringValue(item.ShardId),
+		})
+	}
+
+	return results, nil
+}
+
+// shards lists the hash key ranges of the open shards of the stream
+func (t *KinesisTransport) shards(ctx context.Context) ([]shardRange, error) {
+	var shards []shardRange
+	input := &kinesis.ListShardsInput{StreamName: aws.String(t.StreamName)}
+	for {
+		output, err := t.Kinesis.ListShardsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, shard := range output.Shards {
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				// closed by resharding
+				continue
+			}
+			r, err := newShardRange(shard)
+			if err != nil {
+				return nil, err
+			}
+			shards = append(shards, r)
+		}
+
+		if aws.StringValue(output.NextToken) == "" {
+			return shards, nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: output.NextToken}
+	}
+}
+
+// explicitHashKey returns nil if the record has no explicit hash key
+func explicitHashKey(record *Record) *string {
+	if record.ExplicitHashKey == "" {
+		return nil
+	}
+	return aws.String(record.ExplicitHashKey)
+}
@@ -0,0 +1,154 @@
+package historyin
+
+import (
+	"context"
+	"testing"
+
+	"code.justin.tv/foundation/history.v2/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type KinesisTransportSuite struct {
+	suite.Suite
+	mockKinesis *mocks.KinesisAPI
+	transport   *KinesisTransport
+}
+
+func (s *KinesisTransportSuite) SetupTest() {
+	s.mockKinesis = new(mocks.KinesisAPI)
+	s.transport = &KinesisTransport{
+		StreamName: "my-stream",
+		Kinesis:    s.mockKinesis,
+	}
+}
+
+func (s *KinesisTransportSuite) TearDownTest() {
+	s.mockKinesis.AssertExpectations(s.T())
+}
+
+func (s *KinesisTransportSuite) TestPut() {
+	s.mockKinesis.
+		On("PutRecordWithContext", mock.Anything, &kinesis.PutRecordInput{
+			Data:         []byte("{}"),
+			PartitionKey: aws.String("my-key"),
+			StreamName:   aws.String("my-stream"),
+		}).
+		Return(&kinesis.PutRecordOutput{}, nil)
+
+	s.Require().NoError(s.transport.Put(context.Background(), &Record{
+		PartitionKey: "my-key",
+		Data:         []byte("{}"),
+	}))
+}
+
+func (s *KinesisTransportSuite) TestPutBatch() {
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, &kinesis.PutRecordsInput{
+			StreamName: aws.String("my-stream"),
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{Data: []byte("{}"), PartitionKey: aws.String("sent")},
+				{Data: []byte("{}"), PartitionKey: aws.String("failed")},
+			},
+		}).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{
+					SequenceNumber: aws.String("49590338271490256608559692538361571095921575989136588898"),
+					ShardId:        aws.String("shardId-000000000000"),
+				},
+				{
+					ErrorCode:    aws.String("InternalFailure"),
+					ErrorMessage: aws.String("internal failure"),
+				},
+			},
+		}, nil)
+
+	results, err := s.transport.PutBatch(context.Background(), []*Record{
+		{PartitionKey: "sent", Data: []byte("{}")},
+		{PartitionKey: "failed", Data: []byte("{}")},
+	})
+	s.Require().NoError(err)
+	s.Assert().Equal([]*RecordResult{
+		{
+			SequenceNumber: "49590338271490256608559692538361571095921575989136588898",
+			ShardID:        "shardId-000000000000",
+		},
+		{ErrorCode: "InternalFailure", ErrorMessage: "internal failure"},
+	}, results)
+	s.Assert().False(results[0].Failed())
+	s.Assert().True(results[1].Failed())
+}
+
+func (s *KinesisTransportSuite) TestPutBatchExplicitHashKey() {
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, &kinesis.PutRecordsInput{
+			StreamName: aws.String("my-stream"),
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{Data: []byte("{}"), PartitionKey: aws.String("my-key"), ExplicitHashKey: aws.String("42")},
+			},
+		}).
+		Return(&kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{{}},
+		}, nil)
+
+	_, err := s.transport.PutBatch(context.Background(), []*Record{
+		{PartitionKey: "my-key", ExplicitHashKey: "42", Data: []byte("{}")},
+	})
+	s.Require().NoError(err)
+}
+
+func (s *KinesisTransportSuite) TestPutBatchDifferentLens() {
+	s.mockKinesis.
+		On("PutRecordsWithContext", mock.Anything, mock.Anything).
+		Return(&kinesis.PutRecordsOutput{}, nil)
+
+	_, err := s.transport.PutBatch(context.Background(), []*Record{{}})
+	s.Assert().Equal(errInvalidPutBatchResponse, err)
+}
+
+func (s *KinesisTransportSuite) TestShards() {
+	shard := func(id, start, end string, closed bool) *kinesis.Shard {
+		shard := &kinesis.Shard{
+			ShardId: aws.String(id),
+			HashKeyRange: &kinesis.HashKeyRange{
+				StartingHashKey: aws.String(start),
+				EndingHashKey:   aws.String(end),
+			},
+			SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+		}
+		if closed {
+			shard.SequenceNumberRange.EndingSequenceNumber = aws.String("2")
+		}
+		return shard
+	}
+
+	s.mockKinesis.
+		On("ListShardsWithContext", mock.Anything, &kinesis.ListShardsInput{StreamName: aws.String("my-stream")}).
+		Return(&kinesis.ListShardsOutput{
+			Shards: []*kinesis.Shard{
+				shard("shardId-000000000000", "0", "99", true),
+				shard("shardId-000000000001", "0", "49", false),
+			},
+			NextToken: aws.String("next"),
+		}, nil)
+	s.mockKinesis.
+		On("ListShardsWithContext", mock.Anything, &kinesis.ListShardsInput{NextToken: aws.String("next")}).
+		Return(&kinesis.ListShardsOutput{
+			Shards: []*kinesis.Shard{shard("shardId-000000000002", "50", "99", false)},
+		}, nil)
+
+	shards, err := s.transport.shards(context.Background())
+	s.Require().NoError(err)
+	s.Require().Len(shards, 2, "closed shards should be skipped")
+	s.Assert().Equal("shardId-000000000001", shards[0].id)
+	s.Assert().Equal("49", shards[0].end.String())
+	s.Assert().Equal("shardId-000000000002", shards[1].id)
+	s.Assert().Equal("50", shards[1].start.String())
+}
+
+func TestKinesisTransport(t *testing.T) {
+	suite.Run(t, &KinesisTransportSuite{})
+}
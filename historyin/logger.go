@@ -1,11 +1,134 @@
 package historyin
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+)
+
 // Logger is the logger this package uses
 type Logger interface {
 	Error(error)
 }
 
+// LeveledLogger is a structured logger. keyvals are alternating keys and
+// values, as with log/slog, which *slog.Logger implements.
+type LeveledLogger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Level is the severity of a log message
+type Level int
+
+// Levels of LeveledLogger messages
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// NewLeveledLogger adapts a Logger. Warnings and errors are passed to
+// Logger.Error with their fields appended to the message; debug and info
+// messages are dropped.
+func NewLeveledLogger(logger Logger) LeveledLogger {
+	return &loggerAdapter{Logger: logger}
+}
+
+type loggerAdapter struct {
+	Logger Logger
+}
+
+func (l *loggerAdapter) Debug(msg string, keyvals ...interface{}) {}
+
+func (l *loggerAdapter) Info(msg string, keyvals ...interface{}) {}
+
+func (l *loggerAdapter) Warn(msg string, keyvals ...interface{}) {
+	l.Logger.Error(errors.New(formatMessage(msg, keyvals)))
+}
+
+func (l *loggerAdapter) Error(msg string, keyvals ...interface{}) {
+	l.Logger.Error(errors.New(formatMessage(msg, keyvals)))
+}
+
+// StdLogger is a LeveledLogger writing to a standard library logger as
+// "LEVEL msg key=value ..."
+type StdLogger struct {
+	// Logger defaults to the standard logger
+	Logger *log.Logger
+	// MinLevel is the lowest level logged. Defaults to LevelDebug.
+	MinLevel Level
+}
+
+// Debug implements LeveledLogger
+func (l *StdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info implements LeveledLogger
+func (l *StdLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn implements LeveledLogger
+func (l *StdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error implements LeveledLogger
+func (l *StdLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l *StdLogger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.MinLevel {
+		return
+	}
+
+	line := level.String() + " " + formatMessage(msg, keyvals)
+	if l.Logger == nil {
+		log.Print(line)
+		return
+	}
+	l.Logger.Print(line)
+}
+
+// formatMessage appends key=value fields to msg
+func formatMessage(msg string, keyvals []interface{}) string {
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	for nItem := 0; nItem < len(keyvals); nItem += 2 {
+		var value interface{} = "MISSING"
+		if nItem+1 < len(keyvals) {
+			value = keyvals[nItem+1]
+		}
+		fmt.Fprintf(&buf, " %v=%v", keyvals[nItem], value)
+	}
+	return buf.String()
+}
+
 type nopLogger struct {
 }
 
-func (l nopLogger) Error(err error) {}
+func (l nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (l nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (l nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (l nopLogger) Error(msg string, keyvals ...interface{}) {}
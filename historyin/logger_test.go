@@ -0,0 +1,48 @@
+package historyin
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingLogger records errors passed to a Logger
+type recordingLogger struct {
+	errs []error
+}
+
+func (l *recordingLogger) Error(err error) {
+	l.errs = append(l.errs, err)
+}
+
+func TestNewLeveledLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	leveled := NewLeveledLogger(logger)
+
+	leveled.Debug("debug message", "key", "value")
+	leveled.Info("info message")
+	leveled.Warn("warn message", "records", 2)
+	leveled.Error("error message", "error", errors.New("my-error"), "dangling")
+
+	assert.Equal(t, []error{
+		errors.New("warn message records=2"),
+		errors.New("error message error=my-error dangling=MISSING"),
+	}, logger.errs)
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &StdLogger{
+		Logger:   log.New(&buf, "", 0),
+		MinLevel: LevelInfo,
+	}
+
+	logger.Debug("debug message")
+	logger.Info("info message", "stream", "my-stream")
+	logger.Error("error message", "attempts", 3)
+
+	assert.Equal(t, "INFO info message stream=my-stream\nERROR error message attempts=3\n", buf.String())
+}
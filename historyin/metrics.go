@@ -0,0 +1,43 @@
+package historyin
+
+import "time"
+
+// Metrics receives measurements from clients and batchers. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// AuditsAdded counts audits accepted by Client.Add, Client.AddBatch or a
+	// batcher
+	AuditsAdded(n int)
+	// RecordsSent counts records the transport accepted
+	RecordsSent(n int)
+	// RecordsFailed counts records the transport did not accept by error code.
+	// errorCode is empty if the failure had no code.
+	RecordsFailed(errorCode string, n int)
+	// RecordsRetried counts records a batcher resends
+	RecordsRetried(n int)
+	// RecordsThrottled counts records rejected for exceeding stream throughput
+	RecordsThrottled(n int)
+	// AuditsDropped counts audits dropped because a batcher queue was full
+	AuditsDropped(n int)
+	// BatchSent observes the number of records and bytes in a batch as it is
+	// sent
+	BatchSent(records, bytes int)
+	// BatchFlushed observes how long a batcher took to send a batch, including
+	// retries
+	BatchFlushed(latency time.Duration)
+	// QueueDepth sets the number of audits waiting in the named batcher
+	QueueDepth(batcher string, n int)
+}
+
+type nopMetrics struct {
+}
+
+func (m nopMetrics) AuditsAdded(n int)                     {}
+func (m nopMetrics) RecordsSent(n int)                     {}
+func (m nopMetrics) RecordsFailed(errorCode string, n int) {}
+func (m nopMetrics) RecordsRetried(n int)                  {}
+func (m nopMetrics) RecordsThrottled(n int)                {}
+func (m nopMetrics) AuditsDropped(n int)                   {}
+func (m nopMetrics) BatchSent(records, bytes int)          {}
+func (m nopMetrics) BatchFlushed(latency time.Duration)    {}
+func (m nopMetrics) QueueDepth(batcher string, n int)      {}
@@ -0,0 +1,178 @@
+package historyin
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetrics sums measurements for tests
+type recordingMetrics struct {
+	lock sync.Mutex
+
+	added        int
+	sent         int
+	failed       map[string]int
+	retried      int
+	throttled    int
+	dropped      int
+	batches      int
+	batchRecords int
+	batchBytes   int
+	flushes      int
+	queueDepth   map[string]int
+}
+
+func (m *recordingMetrics) AuditsAdded(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.added += n
+}
+
+func (m *recordingMetrics) RecordsSent(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sent += n
+}
+
+func (m *recordingMetrics) RecordsFailed(errorCode string, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.failed == nil {
+		m.failed = make(map[string]int)
+	}
+	m.failed[errorCode] += n
+}
+
+func (m *recordingMetrics) RecordsRetried(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.retried += n
+}
+
+func (m *recordingMetrics) RecordsThrottled(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.throttled += n
+}
+
+func (m *recordingMetrics) AuditsDropped(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dropped += n
+}
+
+func (m *recordingMetrics) BatchSent(records, bytes int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.batches++
+	m.batchRecords += records
+	m.batchBytes += bytes
+}
+
+func (m *recordingMetrics) BatchFlushed(latency time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.flushes++
+}
+
+func (m *recordingMetrics) QueueDepth(batcher string, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.queueDepth == nil {
+		m.queueDepth = make(map[string]int)
+	}
+	m.queueDepth[batcher] = n
+}
+
+func TestMetrics(t *testing.T) {
+	t.Run("batch", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		b := batch{Name: "my-batcher", Metrics: metrics, MaxQueueRecords: 2, Overflow: OverflowDropNewest}
+
+		for i := 0; i < 3; i++ {
+			b.Add(testAudit())
+		}
+		assert.Equal(t, 2, metrics.added)
+		assert.Equal(t, 1, metrics.dropped)
+		assert.Equal(t, map[string]int{"my-batcher": 2}, metrics.queueDepth)
+
+		b.PopBatch(1, kinesisBatchMaxBytes)
+		assert.Equal(t, map[string]int{"my-batcher": 1}, metrics.queueDepth)
+	})
+
+	t.Run("processor", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		inner := &recordingTransport{failKeys: map[string]bool{"throttled": true}}
+		tp := &transportProcessor{
+			Transport:   &throttlingTransport{recordingTransport: inner},
+			RunnerState: new(runnerState),
+			Logger:      nopLogger{},
+			Metrics:     metrics,
+			MaxAttempts: 2,
+			RetryPolicy: &countingRetryPolicy{},
+		}
+
+		err := tp.Process(context.Background(), []*Record{
+			{PartitionKey: "sent"},
+			{PartitionKey: "throttled"},
+		})
+		require.Error(t, err)
+
+		assert.Equal(t, 1, metrics.sent)
+		assert.Equal(t, map[string]int{kinesis.ErrCodeProvisionedThroughputExceededException: 2}, metrics.failed)
+		assert.Equal(t, 2, metrics.throttled)
+		assert.Equal(t, 1, metrics.retried)
+	})
+
+	t.Run("runner", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		rs := new(runnerState)
+		br := &batchRunner{
+			MaxBatchAge: time.Hour,
+			Batch:       batch{Threshold: 10},
+			BatchProcessor: &transportProcessor{
+				Transport:   &recordingTransport{},
+				RunnerState: rs,
+				Logger:      nopLogger{},
+			},
+			RunnerState: rs,
+			Logger:      nopLogger{},
+			Metrics:     metrics,
+		}
+		require.NoError(t, br.Add(testAudit()))
+		require.NoError(t, br.Add(testAudit()))
+		recordBytes := br.Batch.records[0].size() + br.Batch.records[1].size()
+
+		go br.Run()
+		defer br.Stop(time.Second)
+		require.NoError(t, br.Flush(context.Background()))
+
+		metrics.lock.Lock()
+		defer metrics.lock.Unlock()
+		assert.Equal(t, 1, metrics.batches)
+		assert.Equal(t, 2, metrics.batchRecords)
+		assert.Equal(t, recordBytes, metrics.batchBytes)
+		assert.Equal(t, 1, metrics.flushes)
+	})
+}
+
+// throttlingTransport fails records as throttled instead of InternalFailure
+type throttlingTransport struct {
+	*recordingTransport
+}
+
+func (t *throttlingTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	results, err := t.recordingTransport.PutBatch(ctx, records)
+	for _, result := range results {
+		if result.Failed() {
+			result.ErrorCode = kinesis.ErrCodeProvisionedThroughputExceededException
+		}
+	}
+	return results, err
+}
@@ -0,0 +1,95 @@
+package historyin
+
+import (
+	"code.justin.tv/foundation/history.v2/internal/config"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// Option configures a Client created with NewClient
+type Option func(*Client)
+
+// awsOptions override how the default transport reaches AWS
+type awsOptions struct {
+	// base replaces the preset of Environment
+	base *config.Config
+
+	endpoint    string
+	region      string
+	roleARN     *string
+	credentials *credentials.Credentials
+	session     *session.Session
+	kinesis     kinesisiface.KinesisAPI
+}
+
+// NewClient creates a client for the production history stack, or the stack
+// and stream configured by opts
+func NewClient(opts ...Option) *Client {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithEnvironment sets the history stack to use
+func WithEnvironment(environment string) Option {
+	return func(c *Client) {
+		c.Environment = environment
+	}
+}
+
+// WithStreamName overrides the stream name of the environment
+func WithStreamName(streamName string) Option {
+	return func(c *Client) {
+		c.StreamName = streamName
+	}
+}
+
+// WithRegion overrides the AWS region of the environment
+func WithRegion(region string) Option {
+	return func(c *Client) {
+		c.aws.region = region
+	}
+}
+
+// WithEndpoint sends audits to a custom endpoint, such as LocalStack or
+// kinesalite in local development
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) {
+		c.aws.endpoint = endpoint
+	}
+}
+
+// WithRoleARN overrides the role assumed to send audits. An empty roleARN
+// sends audits with the base credentials without assuming a role.
+func WithRoleARN(roleARN string) Option {
+	return func(c *Client) {
+		c.aws.roleARN = &roleARN
+	}
+}
+
+// WithCredentials sends audits with creds rather than assuming the role of
+// the environment, unless WithRoleARN is also given
+func WithCredentials(creds *credentials.Credentials) Option {
+	return func(c *Client) {
+		c.aws.credentials = creds
+	}
+}
+
+// WithSession shares an existing session rather than creating one. Its
+// credentials are used as is unless WithRoleARN is also given.
+func WithSession(sess *session.Session) Option {
+	return func(c *Client) {
+		c.aws.session = sess
+	}
+}
+
+// WithKinesisAPI sends audits with an existing kinesis client, ignoring the
+// region, endpoint and credential options. The stream type must be kinesis.
+func WithKinesisAPI(api kinesisiface.KinesisAPI) Option {
+	return func(c *Client) {
+		c.aws.kinesis = api
+	}
+}
@@ -0,0 +1,75 @@
+package historyin
+
+import (
+	"testing"
+
+	"code.justin.tv/foundation/history.v2/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions(t *testing.T) {
+	kinesisClient := func(t *testing.T, c *Client) *kinesis.Kinesis {
+		require.NoError(t, c.init())
+		require.IsType(t, &KinesisTransport{}, c.Transport)
+		require.IsType(t, &kinesis.Kinesis{}, c.Transport.(*KinesisTransport).Kinesis)
+		return c.Transport.(*KinesisTransport).Kinesis.(*kinesis.Kinesis)
+	}
+
+	t.Run("stream name and region", func(t *testing.T) {
+		c := NewClient(WithEnvironment("staging"), WithStreamName("my-stream"), WithRegion("eu-west-1"))
+		k := kinesisClient(t, c)
+		assert.Equal(t, "my-stream", c.Transport.(*KinesisTransport).StreamName)
+		assert.Equal(t, "eu-west-1", aws.StringValue(k.Config.Region))
+	})
+
+	t.Run("endpoint", func(t *testing.T) {
+		k := kinesisClient(t, NewClient(WithEndpoint("http://localhost:4566")))
+		assert.Equal(t, "http://localhost:4566", k.Endpoint)
+	})
+
+	t.Run("assumes role of environment", func(t *testing.T) {
+		sess, err := session.NewSession()
+		require.NoError(t, err)
+
+		k := kinesisClient(t, NewClient(WithSession(sess), WithRoleARN("arn:aws:iam::123456789012:role/my-role")))
+		assert.NotEqual(t, sess.Config.Credentials, k.Config.Credentials)
+	})
+
+	t.Run("credentials without role", func(t *testing.T) {
+		creds := credentials.NewStaticCredentials("id", "secret", "")
+		k := kinesisClient(t, NewClient(WithCredentials(creds)))
+		assert.Equal(t, creds, k.Config.Credentials)
+	})
+
+	t.Run("credentials with role", func(t *testing.T) {
+		creds := credentials.NewStaticCredentials("id", "secret", "")
+		k := kinesisClient(t, NewClient(WithCredentials(creds), WithRoleARN("arn:aws:iam::123456789012:role/my-role")))
+		assert.NotEqual(t, creds, k.Config.Credentials)
+	})
+
+	t.Run("session without role", func(t *testing.T) {
+		sess, err := session.NewSession()
+		require.NoError(t, err)
+
+		k := kinesisClient(t, NewClient(WithSession(sess)))
+		assert.Equal(t, sess.Config.Credentials, k.Config.Credentials)
+	})
+
+	t.Run("kinesis api", func(t *testing.T) {
+		api := new(mocks.KinesisAPI)
+		c := NewClient(WithKinesisAPI(api), WithStreamName("my-stream"))
+		require.NoError(t, c.init())
+		assert.Equal(t, &KinesisTransport{StreamName: "my-stream", Kinesis: api}, c.Transport)
+	})
+
+	t.Run("kinesis api with firehose", func(t *testing.T) {
+		c := NewClient(WithKinesisAPI(new(mocks.KinesisAPI)))
+		c.StreamType = StreamTypeFirehose
+		assert.Equal(t, errKinesisAPIStreamType, c.init())
+	})
+}
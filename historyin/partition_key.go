@@ -0,0 +1,59 @@
+package historyin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// kinesis limit of partition keys in unicode characters
+const maxPartitionKeyLength = 256
+
+// PartitionKeyFunc picks the partition key of the record of an audit, which
+// decides its shard. Audits with the same partition key land on the same
+// shard, but are not guaranteed to be read in the order they were added: an
+// audit resent after the rest of its batch succeeded is read after later
+// audits of its key. An explicit hash key, if not empty, picks the shard
+// instead of the hash of the partition key.
+type PartitionKeyFunc func(audit *Audit) (partitionKey, explicitHashKey string)
+
+// PartitionByUUID spreads audits evenly across shards without ordering. This
+// is the default.
+func PartitionByUUID(audit *Audit) (string, string) {
+	return string(audit.UUID), ""
+}
+
+// PartitionByResource sends the audits of each resource to the same shard
+func PartitionByResource(audit *Audit) (string, string) {
+	return audit.ResourceType + "/" + audit.ResourceID, ""
+}
+
+// PartitionByUser sends the audits of each user to the same shard
+func PartitionByUser(audit *Audit) (string, string) {
+	return audit.UserID, ""
+}
+
+// ExplicitHashKey sends each audit to the shard whose hash key range contains
+// the decimal 128-bit hash key returned by hashKey
+func ExplicitHashKey(hashKey func(audit *Audit) string) PartitionKeyFunc {
+	return func(audit *Audit) (string, string) {
+		return string(audit.UUID), hashKey(audit)
+	}
+}
+
+// partitionKey applies fn, falling back to the UUID for empty keys and hashing
+// keys too long for kinesis
+func partitionKey(fn PartitionKeyFunc, audit *Audit) (string, string) {
+	if fn == nil {
+		fn = PartitionByUUID
+	}
+
+	key, hashKey := fn(audit)
+	if key == "" {
+		key = string(audit.UUID)
+	}
+	if len([]rune(key)) > maxPartitionKeyLength {
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	return key, hashKey
+}
@@ -0,0 +1,49 @@
+package historyin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionKey(t *testing.T) {
+	audit := testAudit()
+	audit.UUID = "myuuidmyuuidmyuuidmyuuidmyuuidmyuuid"
+
+	for name, tc := range map[string]struct {
+		fn              PartitionKeyFunc
+		partitionKey    string
+		explicitHashKey string
+	}{
+		"default":  {nil, "myuuidmyuuidmyuuidmyuuidmyuuidmyuuid", ""},
+		"uuid":     {PartitionByUUID, "myuuidmyuuidmyuuidmyuuidmyuuidmyuuid", ""},
+		"resource": {PartitionByResource, "my-resource-type/my-resource-id", ""},
+		"user":     {PartitionByUser, "my-user-id", ""},
+		"explicit hash key": {
+			ExplicitHashKey(func(*Audit) string { return "42" }),
+			"myuuidmyuuidmyuuidmyuuidmyuuidmyuuid",
+			"42",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			key, hashKey := partitionKey(tc.fn, audit)
+			assert.Equal(t, tc.partitionKey, key)
+			assert.Equal(t, tc.explicitHashKey, hashKey)
+		})
+	}
+
+	t.Run("empty falls back to uuid", func(t *testing.T) {
+		key, _ := partitionKey(func(*Audit) (string, string) { return "", "" }, audit)
+		assert.Equal(t, string(audit.UUID), key)
+	})
+
+	t.Run("too long is hashed", func(t *testing.T) {
+		long := func(a *Audit) (string, string) { return strings.Repeat(a.ResourceID, 100), "" }
+		key, _ := partitionKey(long, audit)
+		assert.Len(t, key, 64)
+
+		again, _ := partitionKey(long, audit)
+		assert.Equal(t, key, again)
+	})
+}
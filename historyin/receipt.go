@@ -0,0 +1,66 @@
+package historyin
+
+import (
+	"context"
+	"sync"
+)
+
+// Delivery is where an audit was stored by the stream
+type Delivery struct {
+	// SequenceNumber and ShardID are set by kinesis data streams
+	SequenceNumber string
+	ShardID        string
+}
+
+// Receipt resolves once a batcher has delivered an audit or given up on it
+type Receipt struct {
+	once     sync.Once
+	done     chan struct{}
+	delivery *Delivery
+	err      error
+}
+
+func newReceipt() *Receipt {
+	return &Receipt{done: make(chan struct{})}
+}
+
+// Done is closed when the receipt resolves
+func (r *Receipt) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait waits until the audit is delivered or given up on, or ctx is done. The
+// error is the last failure of an audit that was dead lettered or dropped, or
+// ErrBatcherStopped if the batcher stopped first.
+func (r *Receipt) Wait(ctx context.Context) (*Delivery, error) {
+	select {
+	case <-r.done:
+		return r.delivery, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve resolves the receipt. Only the first call has an effect.
+func (r *Receipt) resolve(delivery *Delivery, err error) {
+	r.once.Do(func() {
+		r.delivery = delivery
+		r.err = err
+		close(r.done)
+	})
+}
+
+// resolveRecord resolves the receipt of a record, if any
+func resolveRecord(record *Record, delivery *Delivery, err error) {
+	if record.receipt != nil {
+		record.receipt.resolve(delivery, err)
+	}
+}
+
+// NewResolvedReceipt returns a receipt already resolved with delivery and err,
+// for fakes of Batcher
+func NewResolvedReceipt(delivery *Delivery, err error) *Receipt {
+	r := newReceipt()
+	r.resolve(delivery, err)
+	return r
+}
@@ -0,0 +1,118 @@
+package historyin
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceipt(t *testing.T) {
+	t.Run("resolves once", func(t *testing.T) {
+		receipt := newReceipt()
+		receipt.resolve(&Delivery{SequenceNumber: "1", ShardID: "shard-1"}, nil)
+		receipt.resolve(nil, errors.New("my-error"))
+
+		<-receipt.Done()
+		delivery, err := receipt.Wait(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, &Delivery{SequenceNumber: "1", ShardID: "shard-1"}, delivery)
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		receipt := NewResolvedReceipt(nil, ErrQueueFull)
+		_, err := receipt.Wait(context.Background())
+		assert.Equal(t, ErrQueueFull, err)
+	})
+
+	t.Run("context done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+
+		_, err := newReceipt().Wait(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		t.Run("delivered", func(t *testing.T) {
+			b := batch{}
+			receipt, err := b.AddWithReceipt(context.Background(), testAudit())
+			require.NoError(t, err)
+
+			tp := &transportProcessor{
+				Transport:   &sequencingTransport{},
+				RunnerState: new(runnerState),
+				Logger:      nopLogger{},
+			}
+			require.NoError(t, tp.Process(context.Background(), b.PopBatch(10, kinesisBatchMaxBytes)))
+
+			delivery, err := receipt.Wait(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, &Delivery{SequenceNumber: "0", ShardID: "shardId-000000000000"}, delivery)
+		})
+
+		t.Run("dead lettered", func(t *testing.T) {
+			b := batch{}
+			receipt, err := b.AddWithReceipt(context.Background(), testAudit())
+			require.NoError(t, err)
+
+			tp := &transportProcessor{
+				Transport:   &recordingTransport{failKeys: map[string]bool{b.records[0].PartitionKey: true}},
+				RunnerState: new(runnerState),
+				Logger:      nopLogger{},
+				MaxAttempts: 1,
+			}
+			require.Error(t, tp.Process(context.Background(), b.PopBatch(10, kinesisBatchMaxBytes)))
+
+			_, err = receipt.Wait(context.Background())
+			assert.Equal(t, &RecordFailedError{ErrorCode: "InternalFailure"}, err)
+		})
+
+		t.Run("dropped", func(t *testing.T) {
+			b := batch{MaxQueueRecords: 1, Overflow: OverflowDropOldest}
+			receipt, err := b.AddWithReceipt(context.Background(), testAudit())
+			require.NoError(t, err)
+			require.NoError(t, b.Add(testAudit()))
+
+			_, err = receipt.Wait(context.Background())
+			assert.Equal(t, ErrQueueFull, err)
+		})
+
+		t.Run("closed", func(t *testing.T) {
+			b := batch{}
+			receipt, err := b.AddWithReceipt(context.Background(), testAudit())
+			require.NoError(t, err)
+			b.Close()
+
+			_, err = receipt.Wait(context.Background())
+			assert.Equal(t, ErrBatcherStopped, err)
+		})
+
+		t.Run("invalid audit", func(t *testing.T) {
+			b := batch{}
+			receipt, err := b.AddWithReceipt(context.Background(), &Audit{})
+			assert.Error(t, err)
+			assert.Nil(t, receipt)
+		})
+	})
+}
+
+// sequencingTransport sends every record, numbering them in order
+type sequencingTransport struct {
+	recordingTransport
+	next int
+}
+
+func (t *sequencingTransport) PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error) {
+	results, err := t.recordingTransport.PutBatch(ctx, records)
+	for _, result := range results {
+		result.SequenceNumber = strconv.Itoa(t.next)
+		result.ShardID = "shardId-000000000000"
+		t.next++
+	}
+	return results, err
+}
@@ -0,0 +1,68 @@
+package historyin
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Record is a marshalled audit to send to history
+type Record struct {
+	PartitionKey string
+	// ExplicitHashKey, if set, overrides the hash of PartitionKey to pick a shard
+	ExplicitHashKey string
+	Data            []byte
+
+	// spanContext is the span the audit was added in, linked from the span
+	// that sends it
+	spanContext SpanContext
+	// receipt, if set, is resolved when the record is delivered or given up on
+	receipt *Receipt
+}
+
+// RecordTooLargeError is returned when a marshalled audit is over the max
+// record size of the transport
+type RecordTooLargeError struct {
+	Size    int
+	MaxSize int
+}
+
+func (e *RecordTooLargeError) Error() string {
+	return fmt.Sprintf("record is %d bytes, over the max of %d bytes", e.Size, e.MaxSize)
+}
+
+// size is the number of bytes a record counts towards transport limits
+func (r *Record) size() int {
+	return len(r.Data) + len(r.PartitionKey) + len(r.ExplicitHashKey)
+}
+
+// checkSize returns a *RecordTooLargeError if a record is over maxSize
+func (r *Record) checkSize(maxSize int) error {
+	if size := r.size(); size > maxSize {
+		return &RecordTooLargeError{Size: size, MaxSize: maxSize}
+	}
+	return nil
+}
+
+// newRecord fills and validates an audit and marshals it into an envelope
+// produced by service, keyed by partitionKeyFunc, or the UUID if nil
+func newRecord(audit *Audit, partitionKeyFunc PartitionKeyFunc, service string) (*Record, error) {
+	if err := audit.fillOptional(); err != nil {
+		return nil, err
+	}
+
+	if err := audit.Validate(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(newEnvelope(audit, service))
+	if err != nil {
+		return nil, err
+	}
+
+	key, hashKey := partitionKey(partitionKeyFunc, audit)
+	return &Record{
+		PartitionKey:    key,
+		ExplicitHashKey: hashKey,
+		Data:            data,
+	}, nil
+}
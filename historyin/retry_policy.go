@@ -0,0 +1,98 @@
+package historyin
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// fatalErrorCodes are aws error codes that will fail again if retried
+var fatalErrorCodes = map[string]bool{
+	kinesis.ErrCodeResourceNotFoundException: true,
+	kinesis.ErrCodeInvalidArgumentException:  true,
+	kinesis.ErrCodeKMSAccessDeniedException:  true,
+	kinesis.ErrCodeKMSDisabledException:      true,
+	kinesis.ErrCodeKMSInvalidStateException:  true,
+	kinesis.ErrCodeKMSNotFoundException:      true,
+	kinesis.ErrCodeKMSOptInRequired:          true,
+	"AccessDeniedException":                  true,
+	"InvalidSignatureException":              true,
+	"UnrecognizedClientException":            true,
+	"ValidationException":                    true,
+}
+
+// throttleErrorCodes are aws error codes of records rejected for exceeding
+// stream throughput
+var throttleErrorCodes = map[string]bool{
+	kinesis.ErrCodeProvisionedThroughputExceededException: true,
+	firehose.ErrCodeServiceUnavailableException:           true,
+}
+
+// RetryPolicy decides when and whether a batcher resends records that failed
+type RetryPolicy interface {
+	// Backoff returns how long to wait before the nth consecutive retry,
+	// starting at 1
+	Backoff(retry int) time.Duration
+	// Retryable returns false if err will not succeed on retry. err is either
+	// the error of a whole batch or a *RecordFailedError.
+	Retryable(err error) bool
+}
+
+// ExponentialBackoff is a RetryPolicy with capped exponential backoff and full
+// jitter. Errors from missing streams, bad credentials, denied access and
+// invalid requests are not retried.
+type ExponentialBackoff struct {
+	// BaseDelay is the max wait before the first retry. Defaults to 100ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait before any retry. Defaults to 10s.
+	MaxDelay time.Duration
+
+	// jitter is seeded per policy so processes do not retry in lockstep
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+// Backoff implements RetryPolicy
+func (p *ExponentialBackoff) Backoff(retry int) time.Duration {
+	baseDelay := p.BaseDelay
+	if baseDelay <= 0 {
+		baseDelay = retryBaseDelay
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = retryMaxDelay
+	}
+
+	delay := maxDelay
+	// stop doubling before overflowing
+	if retry <= 62 {
+		if d := baseDelay << uint(retry-1); d > 0 && d < maxDelay {
+			delay = d
+		}
+	}
+
+	return time.Duration(p.int63n(int64(delay) + 1))
+}
+
+func (p *ExponentialBackoff) int63n(n int64) int64 {
+	p.randLock.Lock()
+	defer p.randLock.Unlock()
+
+	if p.rand == nil {
+		p.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return p.rand.Int63n(n)
+}
+
+// Retryable implements RetryPolicy
+func (p *ExponentialBackoff) Retryable(err error) bool {
+	return !fatalErrorCodes[errorCode(err)]
+}
@@ -0,0 +1,72 @@
+package historyin
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	t.Run("Backoff", func(t *testing.T) {
+		policy := &ExponentialBackoff{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+		for retry, maxDelay := range map[int]time.Duration{
+			1:   time.Second,
+			2:   2 * time.Second,
+			3:   4 * time.Second,
+			4:   5 * time.Second,
+			100: 5 * time.Second,
+		} {
+			for i := 0; i < 100; i++ {
+				delay := policy.Backoff(retry)
+				assert.True(t, delay >= 0 && delay <= maxDelay, "retry %d: %s over %s", retry, delay, maxDelay)
+			}
+		}
+	})
+
+	t.Run("concurrent Backoff", func(t *testing.T) {
+		policy := &ExponentialBackoff{}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for retry := 1; retry < 10; retry++ {
+					policy.Backoff(retry)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		policy := &ExponentialBackoff{}
+		assert.True(t, policy.Backoff(1) <= retryBaseDelay)
+		assert.True(t, policy.Backoff(1000) <= retryMaxDelay)
+	})
+
+	t.Run("Retryable", func(t *testing.T) {
+		policy := &ExponentialBackoff{}
+		for _, tc := range []struct {
+			Name      string
+			Err       error
+			Retryable bool
+		}{
+			{"throttled", awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "", nil), true},
+			{"expired token", awserr.New("ExpiredTokenException", "", nil), true},
+			{"network", errors.New("connection reset"), true},
+			{"record internal failure", &RecordFailedError{ErrorCode: "InternalFailure"}, true},
+			{"stream not found", awserr.New(kinesis.ErrCodeResourceNotFoundException, "", nil), false},
+			{"access denied", awserr.New("AccessDeniedException", "", nil), false},
+			{"record kms access denied", &RecordFailedError{ErrorCode: kinesis.ErrCodeKMSAccessDeniedException}, false},
+		} {
+			t.Run(tc.Name, func(t *testing.T) {
+				assert.Equal(t, tc.Retryable, policy.Retryable(tc.Err))
+			})
+		}
+	})
+}
@@ -1,14 +1,9 @@
 package historyin
 
 import (
-	"errors"
 	"time"
 )
 
-var (
-	errRunnerStopped = errors.New("runner has been stopped")
-)
-
 type runnerContext struct {
 	runnerState *runnerState
 }
@@ -23,7 +18,7 @@ func (ctx runnerContext) Done() <-chan struct{} {
 
 func (ctx runnerContext) Err() error {
 	if ctx.runnerState.Stopped() {
-		return errRunnerStopped
+		return ErrBatcherStopped
 	}
 	return nil
 }
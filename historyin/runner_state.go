@@ -16,7 +16,8 @@ type runnerState struct {
 	doneChan chan struct{}
 
 	// notifies runner to not listen on channels triggering threshold breaches
-	draining bool
+	draining  bool
+	drainLock sync.Mutex
 
 	stopped  bool
 	stopLock sync.Mutex
@@ -26,25 +27,30 @@ type runnerState struct {
 func (rs *runnerState) init() {
 	rs.initSync.Do(func() {
 		rs.doneChan = make(chan struct{}, 1)
-		rs.stopChan = make(chan struct{}, 1)
+		rs.stopChan = make(chan struct{})
 	})
 }
 
 func (rs *runnerState) Drain() {
+	rs.drainLock.Lock()
 	rs.draining = true
+	rs.drainLock.Unlock()
 }
 
 func (rs *runnerState) IsDraining() bool {
+	rs.drainLock.Lock()
+	defer rs.drainLock.Unlock()
+
 	return rs.draining
 }
 
-// Stop stops the runner
+// Stop stops the runner, waking everything waiting on it
 func (rs *runnerState) Stop() {
 	rs.init()
 
 	rs.stopLock.Lock()
 	if !rs.stopped {
-		rs.stopChan <- struct{}{}
+		close(rs.stopChan)
 		rs.stopped = true
 	}
 	rs.stopLock.Unlock()
@@ -54,6 +60,9 @@ func (rs *runnerState) Stop() {
 func (rs *runnerState) Stopped() bool {
 	rs.init()
 
+	rs.stopLock.Lock()
+	defer rs.stopLock.Unlock()
+
 	return rs.stopped
 }
 
@@ -73,7 +82,10 @@ func (rs *runnerState) MarkDone() {
 func (rs *runnerState) Wait(timeout time.Duration) bool {
 	rs.init()
 
-	if rs.done {
+	rs.doneLock.Lock()
+	done := rs.done
+	rs.doneLock.Unlock()
+	if done {
 		return true
 	}
 
@@ -1,6 +1,7 @@
 package historyin
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -57,4 +58,24 @@ func TestRunnerState(t *testing.T) {
 		s.Drain()
 		assert.True(t, s.IsDraining())
 	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		var s runnerState
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Drain()
+				s.IsDraining()
+				s.Stop()
+				s.Stopped()
+				s.MarkDone()
+			}()
+		}
+		assert.True(t, s.Wait(time.Second))
+		wg.Wait()
+		assert.True(t, s.Stopped())
+		assert.True(t, s.IsDraining())
+	})
 }
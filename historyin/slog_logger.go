@@ -0,0 +1,15 @@
+//go:build go1.21
+// +build go1.21
+
+package historyin
+
+import "log/slog"
+
+// NewSlogLogger adapts a log/slog logger, defaulting to slog.Default(). A
+// *slog.Logger can also be used as a LeveledLogger directly.
+func NewSlogLogger(logger *slog.Logger) LeveledLogger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
@@ -0,0 +1,23 @@
+//go:build go1.21
+// +build go1.21
+
+package historyin
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	logger.Debug("retrying records", "retry", 2, "records", 10)
+	assert.Contains(t, buf.String(), "level=DEBUG")
+	assert.Contains(t, buf.String(), `msg="retrying records" retry=2 records=10`)
+
+	assert.Equal(t, slog.Default(), NewSlogLogger(nil))
+}
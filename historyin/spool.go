@@ -0,0 +1,359 @@
+package historyin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// size when the active spool segment is rotated
+	spoolSegmentMaxBytes = 16 * 1024 * 1024
+
+	spoolSegmentExt = ".seg"
+
+	// file locked by the spool using a directory
+	spoolLockFile = "lock"
+
+	// segment file names are zero padded ids so they sort in order
+	spoolSegmentIDWidth = 20
+
+	// entry header is the payload length followed by its checksum
+	spoolEntryHeaderSize = 8
+)
+
+var (
+	errSpoolClosed           = errors.New("spool has been closed")
+	errSpoolChecksumMismatch = errors.New("spool entry checksum mismatch")
+	errSpoolEntryMalformed   = errors.New("spool entry malformed")
+	errSpoolLocked           = errors.New("spool directory is in use by another batcher")
+
+	spoolChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// spool is a write-ahead log of records added to a batch. Records are
+// appended to segment files in Dir before being queued and acknowledged once
+// sent, so anything unsent can be replayed after a crash. Segments are
+// deleted when every record in them has been acknowledged.
+//
+// A spool locks its directory so only one batch uses it at a time.
+type spool struct {
+	Dir             string
+	MaxSegmentBytes int64
+	Logger          LeveledLogger
+
+	dirLock io.Closer
+
+	lock    sync.Mutex
+	closed  bool
+	active  *spoolSegment
+	pending map[*Record]*spoolSegment
+}
+
+type spoolSegment struct {
+	id      uint64
+	file    *os.File
+	size    int64
+	pending int
+}
+
+// openSpool opens the spool in dir, returning the records left from a
+// previous process in the order they were appended. It returns errSpoolLocked
+// if another spool has dir open.
+func openSpool(dir string, logger LeveledLogger) (*spool, []*Record, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	dirLock, err := lockSpoolDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sp, records, err := readSpool(dir, logger)
+	if err != nil {
+		dirLock.Close()
+		return nil, nil, err
+	}
+	sp.dirLock = dirLock
+	return sp, records, nil
+}
+
+func readSpool(dir string, logger LeveledLogger) (*spool, []*Record, error) {
+	sp := &spool{
+		Dir:             dir,
+		MaxSegmentBytes: spoolSegmentMaxBytes,
+		Logger:          logger,
+		pending:         make(map[*Record]*spoolSegment),
+	}
+
+	ids, err := sp.segmentIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []*Record
+	var nextID uint64
+	for _, id := range ids {
+		segmentRecords, err := sp.readSegment(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		nextID = id + 1
+		if len(segmentRecords) == 0 {
+			if err := os.Remove(sp.segmentPath(id)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		segment := &spoolSegment{id: id, pending: len(segmentRecords)}
+		for _, rec := range segmentRecords {
+			sp.pending[rec] = segment
+		}
+		records = append(records, segmentRecords...)
+	}
+
+	if err := sp.openSegment(nextID); err != nil {
+		return nil, nil, err
+	}
+
+	return sp, records, nil
+}
+
+// Append durably writes a record to the spool
+func (sp *spool) Append(rec *Record) error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	if sp.closed {
+		return errSpoolClosed
+	}
+
+	entry := encodeSpoolEntry(rec)
+	if sp.active.size > 0 && sp.active.size+int64(len(entry)) > sp.MaxSegmentBytes {
+		if err := sp.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := sp.active.file.Write(entry); err != nil {
+		return err
+	}
+	if err := sp.active.file.Sync(); err != nil {
+		return err
+	}
+
+	sp.active.size += int64(len(entry))
+	sp.active.pending++
+	sp.pending[rec] = sp.active
+	return nil
+}
+
+// Ack marks records as sent, deleting segments with no records left to send
+func (sp *spool) Ack(records ...*Record) error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	for _, rec := range records {
+		segment, ok := sp.pending[rec]
+		if !ok {
+			continue
+		}
+		delete(sp.pending, rec)
+
+		segment.pending--
+		if segment.pending == 0 && segment != sp.active {
+			if err := sp.removeSegment(segment); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close closes the active segment. Unacknowledged records are kept on disk to
+// be replayed by the next openSpool.
+func (sp *spool) Close() error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	if sp.closed {
+		return nil
+	}
+	sp.closed = true
+	defer sp.dirLock.Close()
+
+	if err := sp.active.file.Close(); err != nil {
+		return err
+	}
+	if sp.active.pending == 0 {
+		return sp.removeSegment(sp.active)
+	}
+	return nil
+}
+
+func (sp *spool) rotate() error {
+	previous := sp.active
+	if err := previous.file.Close(); err != nil {
+		return err
+	}
+	previous.file = nil
+
+	if err := sp.openSegment(previous.id + 1); err != nil {
+		return err
+	}
+
+	if previous.pending == 0 {
+		return sp.removeSegment(previous)
+	}
+	return nil
+}
+
+func (sp *spool) openSegment(id uint64) error {
+	file, err := os.OpenFile(sp.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	sp.active = &spoolSegment{id: id, file: file}
+	return nil
+}
+
+func (sp *spool) removeSegment(segment *spoolSegment) error {
+	return os.Remove(sp.segmentPath(segment.id))
+}
+
+func (sp *spool) segmentPath(id uint64) string {
+	return filepath.Join(sp.Dir, fmt.Sprintf("%0*d%s", spoolSegmentIDWidth, id, spoolSegmentExt))
+}
+
+// segmentIDs lists the segments in the spool directory in order
+func (sp *spool) segmentIDs() ([]uint64, error) {
+	files, err := ioutil.ReadDir(sp.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint64
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// readSegment reads every intact record in a segment. Reading stops at the
+// first torn or corrupt entry since nothing after it can be trusted.
+func (sp *spool) readSegment(id uint64) ([]*Record, error) {
+	file, err := os.Open(sp.segmentPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []*Record
+	r := bufio.NewReader(file)
+	for {
+		rec, err := decodeSpoolEntry(r)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			sp.Logger.Warn("error reading spool segment", "segment", sp.segmentPath(id), "error", err)
+			return records, nil
+		}
+		records = append(records, rec)
+	}
+}
+
+// encodeSpoolEntry encodes a record as a header followed by a payload of the
+// length prefixed partition key and explicit hash key, then the data
+func encodeSpoolEntry(rec *Record) []byte {
+	payload := make([]byte, 0, 2*binary.MaxVarintLen64+len(rec.PartitionKey)+len(rec.ExplicitHashKey)+len(rec.Data))
+	payload = appendUvarint(payload, uint64(len(rec.PartitionKey)))
+	payload = append(payload, rec.PartitionKey...)
+	payload = appendUvarint(payload, uint64(len(rec.ExplicitHashKey)))
+	payload = append(payload, rec.ExplicitHashKey...)
+	payload = append(payload, rec.Data...)
+
+	entry := make([]byte, spoolEntryHeaderSize, spoolEntryHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.Checksum(payload, spoolChecksumTable))
+	return append(entry, payload...)
+}
+
+func decodeSpoolEntry(r io.Reader) (*Record, error) {
+	header := make([]byte, spoolEntryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	payloadLen := binary.BigEndian.Uint32(header[0:4])
+	if payloadLen > spoolSegmentMaxBytes {
+		return nil, errSpoolEntryMalformed
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, spoolChecksumTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errSpoolChecksumMismatch
+	}
+
+	rec := &Record{}
+	var err error
+	if rec.PartitionKey, payload, err = readSpoolString(payload); err != nil {
+		return nil, err
+	}
+	if rec.ExplicitHashKey, payload, err = readSpoolString(payload); err != nil {
+		return nil, err
+	}
+
+	rec.Data = payload
+	return rec, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// readSpoolString reads a length prefixed string from the start of payload,
+// returning the rest of payload
+func readSpoolString(payload []byte) (string, []byte, error) {
+	n, nLen := binary.Uvarint(payload)
+	if nLen <= 0 || uint64(len(payload)-nLen) < n {
+		return "", nil, errSpoolEntryMalformed
+	}
+
+	end := nLen + int(n)
+	return string(payload[nLen:end]), payload[end:], nil
+}
@@ -0,0 +1,44 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package historyin
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// spool directories locked by this process
+var (
+	spoolDirsLock sync.Mutex
+	spoolDirs     = make(map[string]bool)
+)
+
+// lockSpoolDir takes an exclusive lock on dir, held until the returned closer
+// is closed. Other processes are not excluded on this platform.
+func lockSpoolDir(dir string) (io.Closer, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	spoolDirsLock.Lock()
+	defer spoolDirsLock.Unlock()
+
+	if spoolDirs[dir] {
+		return nil, errSpoolLocked
+	}
+	spoolDirs[dir] = true
+	return spoolDirLock(dir), nil
+}
+
+type spoolDirLock string
+
+func (dir spoolDirLock) Close() error {
+	spoolDirsLock.Lock()
+	defer spoolDirsLock.Unlock()
+
+	delete(spoolDirs, string(dir))
+	return nil
+}
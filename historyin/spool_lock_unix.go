@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package historyin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockSpoolDir takes an exclusive lock on dir, held until the returned closer
+// is closed or the process exits
+func lockSpoolDir(dir string) (io.Closer, error) {
+	file, err := os.OpenFile(filepath.Join(dir, spoolLockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errSpoolLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
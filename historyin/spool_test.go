@@ -0,0 +1,166 @@
+package historyin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	tempDir := func(t *testing.T) string {
+		dir, err := ioutil.TempDir("", "historyin-spool")
+		require.NoError(t, err)
+		return dir
+	}
+
+	segmentFiles := func(t *testing.T, dir string) []string {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+		require.NoError(t, err)
+		return files
+	}
+
+	records := func(n int) []*Record {
+		recs := make([]*Record, n)
+		for i := range recs {
+			recs[i] = &Record{
+				PartitionKey: "key-" + strconv.Itoa(i),
+				Data:         []byte(`{"n":` + strconv.Itoa(i) + `}`),
+			}
+		}
+		return recs
+	}
+
+	t.Run("replays unacknowledged records in order", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		sp, replayed, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+		assert.Empty(t, replayed)
+
+		recs := records(3)
+		for _, rec := range recs {
+			require.NoError(t, sp.Append(rec))
+		}
+		require.NoError(t, sp.Ack(recs[1]))
+		require.NoError(t, sp.Close())
+
+		_, replayed, err = openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+		assert.Equal(t, recs, replayed, "acks are not persisted so whole segments are replayed")
+	})
+
+	t.Run("removes segments once acknowledged", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		sp, _, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+		sp.MaxSegmentBytes = 1
+
+		recs := records(3)
+		for _, rec := range recs {
+			require.NoError(t, sp.Append(rec))
+		}
+		assert.Len(t, segmentFiles(t, dir), 3, "each record should rotate the segment")
+
+		require.NoError(t, sp.Ack(recs[0], recs[1]))
+		assert.Len(t, segmentFiles(t, dir), 1, "active segment should be kept")
+
+		require.NoError(t, sp.Ack(recs[2]))
+		require.NoError(t, sp.Close())
+		assert.Empty(t, segmentFiles(t, dir))
+
+		_, replayed, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+		assert.Empty(t, replayed)
+	})
+
+	t.Run("ignores torn and corrupt entries", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		sp, _, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+
+		recs := records(2)
+		for _, rec := range recs {
+			require.NoError(t, sp.Append(rec))
+		}
+		require.NoError(t, sp.Close())
+
+		files := segmentFiles(t, dir)
+		require.Len(t, files, 1)
+		data, err := ioutil.ReadFile(files[0])
+		require.NoError(t, err)
+
+		t.Run("torn", func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(files[0], data[:len(data)-1], 0600))
+
+			sp, replayed, err := openSpool(dir, nopLogger{})
+			require.NoError(t, err)
+			require.NoError(t, sp.Close())
+			assert.Equal(t, recs[:1], replayed)
+		})
+
+		t.Run("corrupt", func(t *testing.T) {
+			corrupt := append([]byte{}, data...)
+			corrupt[len(corrupt)-1] ^= 0xff
+			require.NoError(t, ioutil.WriteFile(files[0], corrupt, 0600))
+
+			sp, replayed, err := openSpool(dir, nopLogger{})
+			require.NoError(t, err)
+			require.NoError(t, sp.Close())
+			assert.Equal(t, recs[:1], replayed)
+		})
+	})
+
+	t.Run("replays explicit hash keys", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		sp, _, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+
+		recs := records(2)
+		recs[0].ExplicitHashKey = "170141183460469231731687303715884105728"
+		for _, rec := range recs {
+			require.NoError(t, sp.Append(rec))
+		}
+		require.NoError(t, sp.Close())
+
+		_, replayed, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+		assert.Equal(t, recs, replayed)
+	})
+
+	t.Run("locks its directory", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		sp, _, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+		_, _, err = openSpool(dir, nopLogger{})
+		assert.Equal(t, errSpoolLocked, err)
+
+		require.NoError(t, sp.Close())
+		sp, _, err = openSpool(dir, nopLogger{})
+		require.NoError(t, err, "closing should release the lock")
+		require.NoError(t, sp.Close())
+	})
+
+	t.Run("append after close", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		sp, _, err := openSpool(dir, nopLogger{})
+		require.NoError(t, err)
+		require.NoError(t, sp.Close())
+		assert.Equal(t, errSpoolClosed, sp.Append(records(1)[0]))
+	})
+}
@@ -0,0 +1,107 @@
+package historyin
+
+import (
+	"context"
+)
+
+// span attributes
+const (
+	attrMessagingSystem = "messaging.system"
+	attrDestinationName = "messaging.destination.name"
+	attrRecords         = "historyin.records"
+	attrBytes           = "historyin.bytes"
+	attrRetries         = "historyin.retries"
+	attrFailedRecords   = "historyin.failed_records"
+)
+
+// Tracer creates spans for audits sent by clients and batchers.
+// Implementations must be safe for concurrent use. The historyinotel package
+// implements it with OpenTelemetry.
+type Tracer interface {
+	// SpanContext returns the span in ctx, or nil if ctx has none
+	SpanContext(ctx context.Context) SpanContext
+	// Start starts a span as a child of the span in ctx, returning a context
+	// with the new span
+	Start(ctx context.Context, name string, opts SpanOptions) (context.Context, Span)
+}
+
+// SpanContext identifies a span
+type SpanContext interface {
+	// TraceID returns the hex encoded ID of the trace
+	TraceID() string
+	// SpanID returns the hex encoded ID of the span
+	SpanID() string
+}
+
+// SpanOptions describe a span as it is started
+type SpanOptions struct {
+	Attributes []Attribute
+	// Links are spans the new span relates to, like the spans audits in a
+	// batch were added in
+	Links []SpanContext
+}
+
+// Attribute is a key value pair describing a span. Value is a string or int.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// End ends the span, marking it failed if err is not nil
+	End(err error)
+}
+
+type nopTracer struct {
+}
+
+func (t nopTracer) SpanContext(ctx context.Context) SpanContext { return nil }
+func (t nopTracer) Start(ctx context.Context, name string, opts SpanOptions) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct {
+}
+
+func (s nopSpan) SetAttributes(attrs ...Attribute) {}
+func (s nopSpan) End(err error)                    {}
+
+// captureTrace fills the trace and span IDs of an audit from the span in ctx
+// unless they are already set
+func captureTrace(ctx context.Context, tracer Tracer, audit *Audit) {
+	spanContext := tracer.SpanContext(ctx)
+	if spanContext == nil || audit.TraceID != "" {
+		return
+	}
+
+	audit.TraceID = spanContext.TraceID()
+	audit.SpanID = spanContext.SpanID()
+}
+
+// transportAttributes describes the stream a transport sends to
+func transportAttributes(t Transport) []Attribute {
+	system, streamName := describeTransport(t)
+	if system == "" {
+		return nil
+	}
+
+	return []Attribute{
+		{Key: attrMessagingSystem, Value: system},
+		{Key: attrDestinationName, Value: streamName},
+	}
+}
+
+// recordsAttributes describes the records sent in a span
+func recordsAttributes(records []*Record) []Attribute {
+	var bytes int
+	for _, record := range records {
+		bytes += record.size()
+	}
+
+	return []Attribute{
+		{Key: attrRecords, Value: len(records)},
+		{Key: attrBytes, Value: bytes},
+	}
+}
@@ -0,0 +1,230 @@
+package historyin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"code.justin.tv/foundation/history.v2/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type testSpanContext struct {
+	traceID string
+	spanID  string
+}
+
+func (sc testSpanContext) TraceID() string { return sc.traceID }
+func (sc testSpanContext) SpanID() string  { return sc.spanID }
+
+type testSpan struct {
+	tracer     *testTracer
+	name       string
+	parent     SpanContext
+	links      []SpanContext
+	attributes map[string]interface{}
+	err        error
+	context    testSpanContext
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) End(err error) {
+	s.err = err
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s)
+}
+
+type testSpanKey struct{}
+
+// testTracer records spans as they end
+type testTracer struct {
+	lock   sync.Mutex
+	nSpans int
+	ended  []*testSpan
+}
+
+func (t *testTracer) SpanContext(ctx context.Context) SpanContext {
+	if span, ok := ctx.Value(testSpanKey{}).(*testSpan); ok {
+		return span.context
+	}
+	return nil
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, opts SpanOptions) (context.Context, Span) {
+	t.lock.Lock()
+	t.nSpans++
+	span := &testSpan{
+		tracer:     t,
+		name:       name,
+		parent:     t.SpanContext(ctx),
+		links:      opts.Links,
+		attributes: make(map[string]interface{}),
+		context: testSpanContext{
+			traceID: fmt.Sprintf("trace-%d", t.nSpans),
+			spanID:  fmt.Sprintf("span-%d", t.nSpans),
+		},
+	}
+	t.lock.Unlock()
+
+	if span.parent != nil {
+		span.context.traceID = span.parent.TraceID()
+	}
+	span.SetAttributes(opts.Attributes...)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func (t *testTracer) Ended() []*testSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]*testSpan(nil), t.ended...)
+}
+
+func TestTracing(t *testing.T) {
+	t.Run("captureTrace", func(t *testing.T) {
+		tracer := new(testTracer)
+		ctx, span := tracer.Start(context.Background(), "request", SpanOptions{})
+		defer span.End(nil)
+
+		audit := testAudit()
+		captureTrace(ctx, tracer, audit)
+		assert.Equal(t, "trace-1", audit.TraceID)
+		assert.Equal(t, "span-1", audit.SpanID)
+
+		require.NoError(t, audit.fillOptional())
+		data, err := json.Marshal(audit)
+		require.NoError(t, err)
+		var raw map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &raw))
+		assert.Equal(t, audit.TraceID, raw["trace_id"])
+		assert.Equal(t, audit.SpanID, raw["span_id"])
+
+		t.Run("keeps existing IDs", func(t *testing.T) {
+			audit := testAudit()
+			audit.TraceID = "my-trace-id"
+			captureTrace(ctx, tracer, audit)
+			assert.Equal(t, "my-trace-id", audit.TraceID)
+		})
+
+		t.Run("no span", func(t *testing.T) {
+			audit := testAudit()
+			captureTrace(context.Background(), tracer, audit)
+			assert.Empty(t, audit.TraceID)
+			assert.Empty(t, audit.SpanID)
+		})
+
+		t.Run("no tracer", func(t *testing.T) {
+			audit := testAudit()
+			captureTrace(ctx, nopTracer{}, audit)
+			assert.Empty(t, audit.TraceID)
+		})
+	})
+
+	t.Run("Client.Add", func(t *testing.T) {
+		tracer := new(testTracer)
+		mockKinesis := new(mocks.KinesisAPI)
+		mockKinesis.
+			On("PutRecordWithContext", mock.Anything, mock.Anything).
+			Return(&kinesis.PutRecordOutput{}, nil)
+		client := &Client{
+			Transport:    &KinesisTransport{StreamName: "my-stream", Kinesis: mockKinesis},
+			Tracer:       tracer,
+			CaptureTrace: true,
+			Metrics:      nopMetrics{},
+		}
+		client.initSync.Do(func() {})
+
+		ctx, parent := tracer.Start(context.Background(), "request", SpanOptions{})
+		audit := testAudit()
+		require.NoError(t, client.Add(ctx, audit))
+		parent.End(nil)
+		assert.Equal(t, "trace-1", audit.TraceID)
+
+		spans := tracer.Ended()
+		require.Len(t, spans, 2)
+		span := spans[0]
+		assert.Equal(t, "historyin.Add", span.name)
+		assert.Equal(t, "span-1", span.parent.SpanID())
+		assert.Equal(t, 1, span.attributes[attrRecords])
+		assert.NotZero(t, span.attributes[attrBytes])
+		assert.Equal(t, "aws_kinesis", span.attributes[attrMessagingSystem])
+		assert.Equal(t, "my-stream", span.attributes[attrDestinationName])
+		assert.NoError(t, span.err)
+	})
+
+	t.Run("Client.Add error", func(t *testing.T) {
+		tracer := new(testTracer)
+		mockKinesis := new(mocks.KinesisAPI)
+		mockKinesis.
+			On("PutRecordWithContext", mock.Anything, mock.Anything).
+			Return(nil, errors.New("kinesis error"))
+		client := &Client{
+			Transport: &KinesisTransport{StreamName: "my-stream", Kinesis: mockKinesis},
+			Tracer:    tracer,
+			Metrics:   nopMetrics{},
+		}
+		client.initSync.Do(func() {})
+
+		require.Error(t, client.Add(context.Background(), testAudit()))
+		spans := tracer.Ended()
+		require.Len(t, spans, 1)
+		assert.Error(t, spans[0].err)
+	})
+
+	t.Run("Process links batched audits", func(t *testing.T) {
+		tracer := new(testTracer)
+		b := batch{Tracer: tracer, CaptureTrace: true}
+
+		ctx, first := tracer.Start(context.Background(), "first", SpanOptions{})
+		require.NoError(t, b.AddContext(ctx, testAudit()))
+		first.End(nil)
+		ctx, second := tracer.Start(context.Background(), "second", SpanOptions{})
+		require.NoError(t, b.AddContext(ctx, testAudit()))
+		second.End(nil)
+
+		mockKinesis := new(mocks.KinesisAPI)
+		mockKinesis.
+			On("PutRecordsWithContext", mock.Anything, mock.Anything).
+			Return(&kinesis.PutRecordsOutput{
+				Records: []*kinesis.PutRecordsResultEntry{
+					{ErrorCode: aws.String("InternalFailure")},
+					{ErrorCode: aws.String("InternalFailure")},
+				},
+			}, nil)
+		tp := &transportProcessor{
+			Transport:   &KinesisTransport{StreamName: "my-stream", Kinesis: mockKinesis},
+			RunnerState: new(runnerState),
+			Logger:      nopLogger{},
+			Tracer:      tracer,
+			MaxAttempts: 2,
+			RetryPolicy: &countingRetryPolicy{},
+		}
+		require.Error(t, tp.Process(context.Background(), b.PopBatch(10, kinesisBatchMaxBytes)))
+
+		spans := tracer.Ended()
+		require.Len(t, spans, 3)
+		span := spans[2]
+		assert.Equal(t, "historyin.Process", span.name)
+		require.Len(t, span.links, 2)
+		assert.Equal(t, "span-1", span.links[0].SpanID())
+		assert.Equal(t, "span-2", span.links[1].SpanID())
+
+		assert.Equal(t, "my-stream", span.attributes[attrDestinationName])
+		assert.Equal(t, 2, span.attributes[attrRecords])
+		assert.Equal(t, 2, span.attributes[attrRetries])
+		assert.Equal(t, 2, span.attributes[attrFailedRecords])
+		assert.Error(t, span.err)
+	})
+}
@@ -0,0 +1,96 @@
+package historyin
+
+import (
+	"context"
+	"fmt"
+)
+
+// Transport sends records to history. KinesisTransport is used by default.
+//
+// Transports with size limits other than kinesis's should implement
+// Limits() TransportLimits so batches are cut to fit.
+type Transport interface {
+	// Put sends a single record
+	Put(ctx context.Context, record *Record) error
+
+	// PutBatch sends records, returning a result for each record in the same
+	// order. An error is returned if none of the records could be sent.
+	PutBatch(ctx context.Context, records []*Record) ([]*RecordResult, error)
+}
+
+// RecordResult is the result of sending a record in a batch
+type RecordResult struct {
+	// ErrorCode is empty if the record was sent
+	ErrorCode    string
+	ErrorMessage string
+
+	// SequenceNumber and ShardID are where kinesis stored a sent record
+	SequenceNumber string
+	ShardID        string
+}
+
+// Failed returns true if the record was not sent
+func (r *RecordResult) Failed() bool {
+	return r.ErrorCode != ""
+}
+
+// RecordFailedError is the error of a record a transport reported as not sent
+type RecordFailedError struct {
+	ErrorCode    string
+	ErrorMessage string
+}
+
+func (e *RecordFailedError) Error() string {
+	return fmt.Sprintf("record failed: %s: %s", e.ErrorCode, e.ErrorMessage)
+}
+
+// TransportLimits are the size limits of a transport
+type TransportLimits struct {
+	// MaxBatchRecords is the max number of records in a PutBatch call
+	MaxBatchRecords int
+	// MaxBatchBytes is the max total size of the records in a PutBatch call
+	MaxBatchBytes int
+	// MaxRecordBytes is the max size of a single record
+	MaxRecordBytes int
+}
+
+// limiter is implemented by transports that declare their limits
+type limiter interface {
+	Limits() TransportLimits
+}
+
+// shardLister is implemented by transports that can list the hash key ranges
+// of the shards records are sent to
+type shardLister interface {
+	shards(ctx context.Context) ([]shardRange, error)
+}
+
+// transportLimits returns the limits of a transport, defaulting to kinesis's
+func transportLimits(t Transport) TransportLimits {
+	if l, ok := t.(limiter); ok {
+		return l.Limits()
+	}
+	return kinesisLimits
+}
+
+// describeTransport returns the messaging system and stream name of the
+// transports in this package, unwrapping decorators
+func describeTransport(t Transport) (system, streamName string) {
+	switch t := t.(type) {
+	case *KinesisTransport:
+		return "aws_kinesis", t.StreamName
+	case *FirehoseTransport:
+		return "aws_firehose", t.DeliveryStreamName
+	case *aggregatingTransport:
+		return describeTransport(t.Transport)
+	case *breakerTransport:
+		return describeTransport(t.Transport)
+	}
+	return "", ""
+}
+
+// transportStreamName returns the stream name of a transport for logging
+func transportStreamName(t Transport) string {
+	_, streamName := describeTransport(t)
+	return streamName
+}
@@ -0,0 +1,143 @@
+package historyin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxIdentifierLength is the max length of Action, UserType, UserID,
+	// ResourceType, ResourceID and ChangeSet.Attribute
+	maxIdentifierLength = 256
+
+	// maxDescriptionLength is the max length of Description
+	maxDescriptionLength = 4096
+
+	// maxCreatedAtSkew is how far in the future CreatedAt may be to allow for
+	// clock drift between hosts
+	maxCreatedAtSkew = time.Hour
+)
+
+var (
+	// ErrFieldRequired is returned for a required field that is empty
+	ErrFieldRequired = errors.New("required field is empty")
+	// ErrFieldTooLong is returned for a field exceeding its max length
+	ErrFieldTooLong = errors.New("field is too long")
+	// ErrFieldControlCharacters is returned for a field with control characters
+	ErrFieldControlCharacters = errors.New("field contains control characters")
+	// ErrInvalidTTL is returned for a TTL that is negative or under a second
+	ErrInvalidTTL = errors.New("TTL must be at least one second")
+	// ErrCreatedAtInFuture is returned for a CreatedAt too far in the future
+	ErrCreatedAtInFuture = errors.New("CreatedAt is too far in the future")
+)
+
+// FieldError is a validation failure of a single Audit field
+type FieldError struct {
+	// Field is the name of the field, e.g. "ResourceID" or "Changes[2].Attribute"
+	Field string
+	// Err is the reason the field is invalid
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err.Error())
+}
+
+// ValidationError is returned by Audit.Validate and lists every invalid field
+type ValidationError struct {
+	Fields []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		msgs = append(msgs, field.Error())
+	}
+	return "invalid audit: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the audit before it is sent. Optional attributes that are
+// unset are not errors since they are filled when the audit is added. A
+// *ValidationError is returned if any field is invalid.
+func (a *Audit) Validate() error {
+	v := new(ValidationError)
+
+	for _, field := range []struct {
+		Name  string
+		Value string
+	}{
+		{"Action", a.Action},
+		{"UserID", a.UserID},
+		{"ResourceType", a.ResourceType},
+		{"ResourceID", a.ResourceID},
+	} {
+		if field.Value == "" {
+			v.add(field.Name, ErrFieldRequired)
+		}
+	}
+
+	v.checkIdentifier("Action", a.Action)
+	v.checkIdentifier("UserType", a.UserType)
+	v.checkIdentifier("UserID", a.UserID)
+	v.checkIdentifier("ResourceType", a.ResourceType)
+	v.checkIdentifier("ResourceID", a.ResourceID)
+
+	if len(a.Description) > maxDescriptionLength {
+		v.add("Description", ErrFieldTooLong)
+	}
+	if hasControlCharacters(a.Description, "\n\t") {
+		v.add("Description", ErrFieldControlCharacters)
+	}
+
+	for nChange, change := range a.Changes {
+		field := fmt.Sprintf("Changes[%d].Attribute", nChange)
+		if change.Attribute == "" {
+			v.add(field, ErrFieldRequired)
+		}
+		v.checkIdentifier(field, change.Attribute)
+	}
+
+	if a.UUID != "" && len(a.UUID) != 36 {
+		v.add("UUID", &InvalidUUIDError{})
+	}
+
+	if ttl := time.Duration(a.TTL); ttl != 0 && ttl < time.Second {
+		v.add("TTL", ErrInvalidTTL)
+	}
+
+	if time.Time(a.CreatedAt).After(time.Now().Add(maxCreatedAtSkew)) {
+		v.add("CreatedAt", ErrCreatedAtInFuture)
+	}
+
+	if len(v.Fields) > 0 {
+		return v
+	}
+	return nil
+}
+
+func (e *ValidationError) add(field string, err error) {
+	e.Fields = append(e.Fields, &FieldError{Field: field, Err: err})
+}
+
+func (e *ValidationError) checkIdentifier(field, value string) {
+	if len(value) > maxIdentifierLength {
+		e.add(field, ErrFieldTooLong)
+	}
+	if hasControlCharacters(value, "") {
+		e.add(field, ErrFieldControlCharacters)
+	}
+}
+
+// hasControlCharacters returns true if value contains a control character
+// that is not in allowed
+func hasControlCharacters(value, allowed string) bool {
+	for _, r := range value {
+		if unicode.IsControl(r) && !strings.ContainsRune(allowed, r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package historyin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	fieldErrors := func(t *testing.T, a *Audit) map[string]error {
+		err := a.Validate()
+		require.Error(t, err)
+		require.IsType(t, &ValidationError{}, err)
+
+		errs := make(map[string]error)
+		for _, field := range err.(*ValidationError).Fields {
+			errs[field.Field] = field.Err
+		}
+		return errs
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, testAudit().Validate())
+	})
+
+	t.Run("valid after filling optional", func(t *testing.T) {
+		a := testAudit()
+		require.NoError(t, a.fillOptional())
+		assert.NoError(t, a.Validate())
+	})
+
+	t.Run("missing required fields", func(t *testing.T) {
+		assert.Equal(t, map[string]error{
+			"Action":       ErrFieldRequired,
+			"UserID":       ErrFieldRequired,
+			"ResourceType": ErrFieldRequired,
+			"ResourceID":   ErrFieldRequired,
+		}, fieldErrors(t, &Audit{}))
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		a := testAudit()
+		a.ResourceID = strings.Repeat("a", maxIdentifierLength+1)
+		a.Description = strings.Repeat("a", maxDescriptionLength+1)
+		assert.Equal(t, map[string]error{
+			"ResourceID":  ErrFieldTooLong,
+			"Description": ErrFieldTooLong,
+		}, fieldErrors(t, a))
+	})
+
+	t.Run("control characters", func(t *testing.T) {
+		a := testAudit()
+		a.UserID = "my-user\x00"
+		a.Description = "line one\nline two\x1b"
+		a.Changes = []ChangeSet{{Attribute: "attr\n"}}
+		assert.Equal(t, map[string]error{
+			"UserID":               ErrFieldControlCharacters,
+			"Description":          ErrFieldControlCharacters,
+			"Changes[0].Attribute": ErrFieldControlCharacters,
+		}, fieldErrors(t, a))
+	})
+
+	t.Run("description allows newlines and tabs", func(t *testing.T) {
+		a := testAudit()
+		a.Description = "line one\n\tline two"
+		assert.NoError(t, a.Validate())
+	})
+
+	t.Run("missing change attribute", func(t *testing.T) {
+		a := testAudit()
+		a.Changes = []ChangeSet{{Attribute: "attr"}, {NewValue: "value"}}
+		assert.Equal(t, map[string]error{
+			"Changes[1].Attribute": ErrFieldRequired,
+		}, fieldErrors(t, a))
+	})
+
+	t.Run("invalid optional attributes", func(t *testing.T) {
+		a := testAudit()
+		a.UUID = "bad-uuid"
+		a.TTL = Duration(-time.Hour)
+		a.CreatedAt = Time(time.Now().Add(24 * time.Hour))
+		assert.Equal(t, map[string]error{
+			"UUID":      &InvalidUUIDError{},
+			"TTL":       ErrInvalidTTL,
+			"CreatedAt": ErrCreatedAtInFuture,
+		}, fieldErrors(t, a))
+	})
+
+	t.Run("error lists every field", func(t *testing.T) {
+		err := (&Audit{Action: "my-action", UserID: "my-user-id"}).Validate()
+		require.Error(t, err)
+		assert.Equal(t,
+			"invalid audit: ResourceType: required field is empty; ResourceID: required field is empty",
+			err.Error())
+	})
+}
@@ -0,0 +1,148 @@
+package historyout
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpoint is the position of a consumer in a shard
+type Checkpoint struct {
+	// SequenceNumber is of the last record handled
+	SequenceNumber string `json:"sequence_number,omitempty"`
+	// SubSequenceNumber is the index of the last audit handled in an
+	// aggregated record
+	SubSequenceNumber int `json:"sub_sequence_number,omitempty"`
+	// ShardEnd is set once a closed shard is read to its end
+	ShardEnd bool `json:"shard_end,omitempty"`
+}
+
+// CheckpointStore persists the checkpoints of a consumer so it resumes where
+// it left off. A store must only be used for one stream.
+type CheckpointStore interface {
+	// Get returns the checkpoint of a shard, or nil if there is none
+	Get(ctx context.Context, shardID string) (*Checkpoint, error)
+	Set(ctx context.Context, shardID string, checkpoint *Checkpoint) error
+}
+
+// MemoryCheckpointStore keeps checkpoints in memory, so a new process starts
+// over. The zero value is ready to use.
+type MemoryCheckpointStore struct {
+	lock        sync.Mutex
+	checkpoints map[string]Checkpoint
+}
+
+// Get implements CheckpointStore
+func (s *MemoryCheckpointStore) Get(ctx context.Context, shardID string) (*Checkpoint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	checkpoint, ok := s.checkpoints[shardID]
+	if !ok {
+		return nil, nil
+	}
+	return &checkpoint, nil
+}
+
+// Set implements CheckpointStore
+func (s *MemoryCheckpointStore) Set(ctx context.Context, shardID string, checkpoint *Checkpoint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.checkpoints == nil {
+		s.checkpoints = make(map[string]Checkpoint)
+	}
+	s.checkpoints[shardID] = *checkpoint
+	return nil
+}
+
+// FileCheckpointStore keeps checkpoints in a JSON file, replaced atomically
+// on every change. A file must only be used by one consumer at a time.
+type FileCheckpointStore struct {
+	path string
+
+	lock        sync.Mutex
+	checkpoints map[string]Checkpoint
+}
+
+// NewFileCheckpointStore returns a store of the checkpoints in path, which is
+// created on the first checkpoint if it does not exist
+func NewFileCheckpointStore(path string) (*FileCheckpointStore, error) {
+	s := &FileCheckpointStore{
+		path:        path,
+		checkpoints: make(map[string]Checkpoint),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.checkpoints); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get implements CheckpointStore
+func (s *FileCheckpointStore) Get(ctx context.Context, shardID string) (*Checkpoint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	checkpoint, ok := s.checkpoints[shardID]
+	if !ok {
+		return nil, nil
+	}
+	return &checkpoint, nil
+}
+
+// Set implements CheckpointStore
+func (s *FileCheckpointStore) Set(ctx context.Context, shardID string, checkpoint *Checkpoint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	previous, existed := s.checkpoints[shardID]
+	s.checkpoints[shardID] = *checkpoint
+	if err := s.write(); err != nil {
+		if existed {
+			s.checkpoints[shardID] = previous
+		} else {
+			delete(s.checkpoints, shardID)
+		}
+		return err
+	}
+	return nil
+}
+
+// write replaces the file with the checkpoints. The lock must be held.
+func (s *FileCheckpointStore) write() error {
+	data, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
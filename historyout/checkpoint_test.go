@@ -0,0 +1,67 @@
+package historyout
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointStores(t *testing.T) {
+	ctx := context.Background()
+
+	testStore := func(t *testing.T, store CheckpointStore) {
+		checkpoint, err := store.Get(ctx, "shard-1")
+		require.NoError(t, err)
+		assert.Nil(t, checkpoint)
+
+		require.NoError(t, store.Set(ctx, "shard-1", &Checkpoint{SequenceNumber: "1", SubSequenceNumber: 2}))
+		checkpoint, err = store.Get(ctx, "shard-1")
+		require.NoError(t, err)
+		assert.Equal(t, &Checkpoint{SequenceNumber: "1", SubSequenceNumber: 2}, checkpoint)
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		testStore(t, new(MemoryCheckpointStore))
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "historyout-checkpoints")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "checkpoints.json")
+
+		store, err := NewFileCheckpointStore(path)
+		require.NoError(t, err)
+		testStore(t, store)
+		require.NoError(t, store.Set(ctx, "shard-2", &Checkpoint{ShardEnd: true}))
+
+		reopened, err := NewFileCheckpointStore(path)
+		require.NoError(t, err)
+		checkpoint, err := reopened.Get(ctx, "shard-1")
+		require.NoError(t, err)
+		assert.Equal(t, &Checkpoint{SequenceNumber: "1", SubSequenceNumber: 2}, checkpoint)
+		checkpoint, err = reopened.Get(ctx, "shard-2")
+		require.NoError(t, err)
+		assert.True(t, checkpoint.ShardEnd)
+
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, files, 1, "temporary files should be renamed")
+	})
+
+	t.Run("file invalid", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "historyout-checkpoints")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "checkpoints.json")
+		require.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0600))
+
+		_, err = NewFileCheckpointStore(path)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,498 @@
+// Package historyout reads audits back from a history kinesis data stream.
+//
+//	consumer := &historyout.Consumer{
+//		StreamName: "history-v3-prod-stream",
+//		Kinesis:    kinesis.New(sess),
+//		Handler: func(ctx context.Context, msg *historyout.Message) error {
+//			log.Println(msg.Audit.Action, msg.Audit.ResourceID)
+//			return nil
+//		},
+//	}
+//	err := consumer.Run(ctx)
+package historyout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"code.justin.tv/foundation/history.v2/internal/kpl"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+const (
+	defaultBatchSize         = 1000
+	defaultPollInterval      = time.Second
+	defaultShardSyncInterval = time.Minute
+
+	// error code of kinesis calls without permission
+	errCodeAccessDenied = "AccessDeniedException"
+)
+
+var (
+	errNoHandler = errors.New("historyout: Consumer.Handler is required")
+	errNoKinesis = errors.New("historyout: Consumer.Kinesis is required")
+
+	// fatalErrorCodes stop the consumer rather than being retried
+	fatalErrorCodes = map[string]bool{
+		kinesis.ErrCodeResourceNotFoundException: true,
+		kinesis.ErrCodeInvalidArgumentException:  true,
+		errCodeAccessDenied:                      true,
+	}
+)
+
+// Message is an audit read from the stream
+type Message struct {
+	Audit *historyin.Audit
+	// SchemaVersion is the envelope version the audit was written in, or 0
+	// for bare audits written before envelopes
+	SchemaVersion int
+	// Producer is what wrote the audit, if it was written in an envelope
+	Producer historyin.Producer
+
+	ShardID        string
+	SequenceNumber string
+	// SubSequenceNumber is the index of the audit in an aggregated record
+	SubSequenceNumber int
+	PartitionKey      string
+	// ArrivedAt is when kinesis stored the record, approximately
+	ArrivedAt time.Time
+}
+
+// Handler handles an audit. Audits of a shard are handled one at a time in
+// the order they were stored, while shards are handled concurrently. An error
+// stops the consumer without checkpointing the audit, so it is handled again
+// when the consumer restarts.
+type Handler func(ctx context.Context, msg *Message) error
+
+// Consumer delivers the audits of a stream to a handler, following resharding
+// so the audits of a partition key are handled in order, and de-aggregating
+// KPL aggregated records. Delivery is at least once.
+type Consumer struct {
+	StreamName string
+	Kinesis    kinesisiface.KinesisAPI
+	Handler    Handler
+
+	// Checkpoints stores how far each shard has been handled. Defaults to a
+	// MemoryCheckpointStore.
+	Checkpoints CheckpointStore
+	// StartAtLatest starts shards without a checkpoint at audits stored after
+	// the consumer starts rather than the oldest retained. Shards created by
+	// resharding always start at their oldest audit.
+	StartAtLatest bool
+
+	// BatchSize is the max records read from a shard at once. Defaults to
+	// 1000.
+	BatchSize int64
+	// PollInterval is how long a shard waits when it has no new records or
+	// reading it fails. Defaults to a second.
+	PollInterval time.Duration
+	// ShardSyncInterval is how often shards are listed to find new ones.
+	// Defaults to a minute.
+	ShardSyncInterval time.Duration
+
+	// Logger receives read failures that are retried and records that are not
+	// audits, which are skipped
+	Logger historyin.LeveledLogger
+
+	initSync sync.Once
+}
+
+func (c *Consumer) init() {
+	c.initSync.Do(func() {
+		if c.Checkpoints == nil {
+			c.Checkpoints = new(MemoryCheckpointStore)
+		}
+		if c.BatchSize == 0 {
+			c.BatchSize = defaultBatchSize
+		}
+		if c.PollInterval == 0 {
+			c.PollInterval = defaultPollInterval
+		}
+		if c.ShardSyncInterval == 0 {
+			c.ShardSyncInterval = defaultShardSyncInterval
+		}
+		if c.Logger == nil {
+			c.Logger = nopLogger{}
+		}
+	})
+}
+
+// Run consumes the stream until ctx is done, returning nil, or the handler or
+// kinesis fails with an error that is not retried, returning it
+func (c *Consumer) Run(ctx context.Context) error {
+	if c.Handler == nil {
+		return errNoHandler
+	}
+	if c.Kinesis == nil {
+		return errNoKinesis
+	}
+	c.init()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &shardSet{
+		consumer: c,
+		running:  make(map[string]bool),
+		ended:    make(map[string]bool),
+		finished: make(chan string),
+		errs:     make(chan error, 1),
+	}
+	defer s.wait()
+
+	ticker := time.NewTicker(c.ShardSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.sync(ctx); err != nil && ctx.Err() == nil {
+			if fatal(err) {
+				return err
+			}
+			c.Logger.Warn("error syncing shards", "stream", c.StreamName, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			s.wait()
+			return s.err()
+		case err := <-s.errs:
+			cancel()
+			s.wait()
+			return err
+		case shardID := <-s.finished:
+			delete(s.running, shardID)
+			s.ended[shardID] = true
+		case <-ticker.C:
+		}
+	}
+}
+
+// shardSet tracks the shards being consumed by Run
+type shardSet struct {
+	consumer *Consumer
+	running  map[string]bool
+	ended    map[string]bool
+	finished chan string
+	errs     chan error
+	group    sync.WaitGroup
+}
+
+// sync starts consuming shards whose parents have ended
+func (s *shardSet) sync(ctx context.Context) error {
+	shards, err := s.consumer.listShards(ctx)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool, len(shards))
+	checkpoints := make(map[string]*Checkpoint, len(shards))
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		listed[shardID] = true
+		if s.running[shardID] || s.ended[shardID] {
+			continue
+		}
+
+		checkpoint, err := s.consumer.Checkpoints.Get(ctx, shardID)
+		if err != nil {
+			return err
+		}
+		if checkpoint != nil && checkpoint.ShardEnd {
+			s.ended[shardID] = true
+			continue
+		}
+		checkpoints[shardID] = checkpoint
+	}
+
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		if s.running[shardID] || s.ended[shardID] {
+			continue
+		}
+
+		// parents that expired from the stream are no longer listed
+		waiting, hasParent := false, false
+		for _, parentID := range []string{aws.StringValue(shard.ParentShardId), aws.StringValue(shard.AdjacentParentShardId)} {
+			if parentID == "" || !listed[parentID] {
+				continue
+			}
+			hasParent = true
+			if !s.ended[parentID] {
+				waiting = true
+			}
+		}
+		if waiting {
+			continue
+		}
+
+		s.running[shardID] = true
+		s.start(ctx, shardID, checkpoints[shardID], hasParent)
+	}
+	return nil
+}
+
+func (s *shardSet) start(ctx context.Context, shardID string, checkpoint *Checkpoint, hasParent bool) {
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+
+		err := s.consumer.consumeShard(ctx, shardID, checkpoint, hasParent)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			select {
+			case s.errs <- err:
+			default:
+			}
+			return
+		}
+
+		select {
+		case s.finished <- shardID:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func (s *shardSet) wait() {
+	s.group.Wait()
+}
+
+// err returns the error of a shard that stopped the consumer, if any
+func (s *shardSet) err() error {
+	select {
+	case err := <-s.errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// listShards lists every shard of the stream
+func (c *Consumer) listShards(ctx context.Context) ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	input := &kinesis.ListShardsInput{StreamName: aws.String(c.StreamName)}
+	for {
+		output, err := c.Kinesis.ListShardsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, output.Shards...)
+
+		if aws.StringValue(output.NextToken) == "" {
+			return shards, nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: output.NextToken}
+	}
+}
+
+// consumeShard handles the audits of a shard from checkpoint until the shard
+// ends or ctx is done. A shard without a checkpoint starts at its oldest
+// record if it has a parent or StartAtLatest is not set.
+func (c *Consumer) consumeShard(ctx context.Context, shardID string, checkpoint *Checkpoint, hasParent bool) error {
+	oldest := hasParent || !c.StartAtLatest
+	iterator, err := c.shardIterator(ctx, shardID, checkpoint, oldest)
+	if err != nil {
+		return c.ignoreDone(ctx, err)
+	}
+
+	for {
+		output, err := c.Kinesis.GetRecordsWithContext(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(c.BatchSize),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if fatal(err) {
+				return err
+			}
+			if errorCode(err) == kinesis.ErrCodeExpiredIteratorException {
+				if iterator, err = c.shardIterator(ctx, shardID, checkpoint, oldest); err != nil {
+					return c.ignoreDone(ctx, err)
+				}
+				continue
+			}
+
+			c.Logger.Warn("error reading shard", "stream", c.StreamName, "shard", shardID, "error", err)
+			if !c.wait(ctx) {
+				return nil
+			}
+			continue
+		}
+
+		handled, handleErr := c.handleRecords(ctx, shardID, checkpoint, output.Records)
+		if handled != checkpoint {
+			checkpoint = handled
+			if err := c.Checkpoints.Set(ctx, shardID, checkpoint); err != nil {
+				return err
+			}
+		}
+		if handleErr != nil {
+			return handleErr
+		}
+
+		if output.NextShardIterator == nil {
+			ended := &Checkpoint{ShardEnd: true}
+			if checkpoint != nil {
+				ended.SequenceNumber = checkpoint.SequenceNumber
+				ended.SubSequenceNumber = checkpoint.SubSequenceNumber
+			}
+			return c.Checkpoints.Set(ctx, shardID, ended)
+		}
+		iterator = output.NextShardIterator
+
+		if len(output.Records) == 0 && !c.wait(ctx) {
+			return nil
+		}
+	}
+}
+
+// handleRecords hands the audits of records after checkpoint to the handler,
+// returning the checkpoint of the last one handled
+func (c *Consumer) handleRecords(ctx context.Context, shardID string, checkpoint *Checkpoint, records []*kinesis.Record) (*Checkpoint, error) {
+	for _, record := range records {
+		sequenceNumber := aws.StringValue(record.SequenceNumber)
+		messages, err := decodeRecord(record)
+		if err != nil {
+			c.Logger.Warn("skipping record that is not an audit",
+				"stream", c.StreamName, "shard", shardID, "sequence_number", sequenceNumber, "error", err)
+		}
+
+		for _, msg := range messages {
+			// records are read from the checkpoint itself when resuming
+			if checkpoint != nil && sequenceNumber == checkpoint.SequenceNumber &&
+				msg.SubSequenceNumber <= checkpoint.SubSequenceNumber {
+				continue
+			}
+
+			msg.ShardID = shardID
+			if err := c.Handler(ctx, msg); err != nil {
+				return checkpoint, err
+			}
+			checkpoint = &Checkpoint{SequenceNumber: sequenceNumber, SubSequenceNumber: msg.SubSequenceNumber}
+		}
+
+		if len(messages) == 0 {
+			checkpoint = &Checkpoint{SequenceNumber: sequenceNumber}
+		}
+	}
+	return checkpoint, nil
+}
+
+// shardIterator returns an iterator at checkpoint, or the oldest or newest
+// record if there is none
+func (c *Consumer) shardIterator(ctx context.Context, shardID string, checkpoint *Checkpoint, oldest bool) (*string, error) {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName: aws.String(c.StreamName),
+		ShardId:    aws.String(shardID),
+	}
+	switch {
+	case checkpoint != nil && checkpoint.SequenceNumber != "":
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAtSequenceNumber)
+		input.StartingSequenceNumber = aws.String(checkpoint.SequenceNumber)
+	case oldest:
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+	default:
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeLatest)
+	}
+
+	output, err := c.Kinesis.GetShardIteratorWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return output.ShardIterator, nil
+}
+
+// wait waits for PollInterval, returning false if ctx is done first
+func (c *Consumer) wait(ctx context.Context) bool {
+	timer := time.NewTimer(c.PollInterval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ignoreDone returns nil instead of err once ctx is done
+func (c *Consumer) ignoreDone(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// decodeRecord decodes the audits of a record, de-aggregating it if needed
+func decodeRecord(record *kinesis.Record) ([]*Message, error) {
+	arrivedAt := aws.TimeValue(record.ApproximateArrivalTimestamp)
+	sequenceNumber := aws.StringValue(record.SequenceNumber)
+
+	if !kpl.IsAggregated(record.Data) {
+		envelope := new(historyin.Envelope)
+		if err := json.Unmarshal(record.Data, envelope); err != nil {
+			return nil, err
+		}
+		return []*Message{{
+			Audit:          envelope.Audit,
+			SchemaVersion:  envelope.SchemaVersion,
+			Producer:       envelope.Producer,
+			SequenceNumber: sequenceNumber,
+			PartitionKey:   aws.StringValue(record.PartitionKey),
+			ArrivedAt:      arrivedAt,
+		}}, nil
+	}
+
+	userRecords, err := kpl.Unmarshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0, len(userRecords))
+	for i, userRecord := range userRecords {
+		envelope := new(historyin.Envelope)
+		if err := json.Unmarshal(userRecord.Data, envelope); err != nil {
+			return messages, err
+		}
+		messages = append(messages, &Message{
+			Audit:             envelope.Audit,
+			SchemaVersion:     envelope.SchemaVersion,
+			Producer:          envelope.Producer,
+			SequenceNumber:    sequenceNumber,
+			SubSequenceNumber: i,
+			PartitionKey:      userRecord.PartitionKey,
+			ArrivedAt:         arrivedAt,
+		})
+	}
+	return messages, nil
+}
+
+func errorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return ""
+}
+
+func fatal(err error) bool {
+	return fatalErrorCodes[errorCode(err)]
+}
+
+// nopLogger discards log messages
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
@@ -0,0 +1,323 @@
+package historyout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"code.justin.tv/foundation/history.v2/historyin"
+	"code.justin.tv/foundation/history.v2/historyin/historyintest/kinesistest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const streamName = "my-stream"
+
+// collector collects handled messages until it has want
+type collector struct {
+	lock     sync.Mutex
+	messages []*Message
+	want     int
+	done     chan struct{}
+	once     sync.Once
+	// fail, if set, fails messages of the resource
+	fail string
+}
+
+func newCollector(want int) *collector {
+	return &collector{want: want, done: make(chan struct{})}
+}
+
+func (c *collector) handle(ctx context.Context, msg *Message) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if msg.Audit.ResourceID == c.fail {
+		c.finish()
+		return errors.New("my-error")
+	}
+
+	c.messages = append(c.messages, msg)
+	if len(c.messages) == c.want {
+		c.finish()
+	}
+	return nil
+}
+
+func (c *collector) finish() {
+	c.once.Do(func() { close(c.done) })
+}
+
+func (c *collector) resourceIDs() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var resourceIDs []string
+	for _, msg := range c.messages {
+		resourceIDs = append(resourceIDs, msg.Audit.ResourceID)
+	}
+	return resourceIDs
+}
+
+// expiringKinesis fails the first expire GetRecords calls with an expired
+// iterator
+type expiringKinesis struct {
+	kinesisiface.KinesisAPI
+
+	lock   sync.Mutex
+	expire int
+}
+
+func (k *expiringKinesis) GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	k.lock.Lock()
+	expired := k.expire > 0
+	k.expire--
+	k.lock.Unlock()
+
+	if expired {
+		return nil, awserr.New(kinesis.ErrCodeExpiredIteratorException, "iterator expired", nil)
+	}
+	return k.KinesisAPI.GetRecordsWithContext(ctx, input, opts...)
+}
+
+type ConsumerTest struct {
+	srv    *kinesistest.Server
+	client *historyin.Client
+}
+
+func newConsumerTest(shards int) *ConsumerTest {
+	srv := kinesistest.NewServer()
+	srv.CreateStream(streamName, shards)
+	return &ConsumerTest{
+		srv:    srv,
+		client: historyin.NewClient(historyin.WithKinesisAPI(srv.Kinesis()), historyin.WithStreamName(streamName)),
+	}
+}
+
+func (ct *ConsumerTest) add(t *testing.T, resourceIDs ...string) {
+	for _, resourceID := range resourceIDs {
+		require.NoError(t, ct.client.Add(context.Background(), &historyin.Audit{
+			Action:       "my-action",
+			UserID:       "my-user-id",
+			ResourceType: "my-resource-type",
+			ResourceID:   resourceID,
+		}))
+	}
+}
+
+func (ct *ConsumerTest) consumer(handler Handler, checkpoints CheckpointStore) *Consumer {
+	return &Consumer{
+		StreamName:        streamName,
+		Kinesis:           ct.srv.Kinesis(),
+		Handler:           handler,
+		Checkpoints:       checkpoints,
+		PollInterval:      5 * time.Millisecond,
+		ShardSyncInterval: 5 * time.Millisecond,
+	}
+}
+
+// run runs a consumer until the collector is done, returning the error of Run
+func run(t *testing.T, consumer *Consumer, col *collector) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- consumer.Run(ctx)
+	}()
+
+	select {
+	case <-col.done:
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for audits")
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(50 * time.Millisecond):
+		cancel()
+		return <-result
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	t.Run("reads every shard", func(t *testing.T) {
+		ct := newConsumerTest(4)
+		defer ct.srv.Close()
+
+		var resourceIDs []string
+		for i := 0; i < 20; i++ {
+			resourceIDs = append(resourceIDs, fmt.Sprint(i))
+		}
+		ct.add(t, resourceIDs...)
+
+		col := newCollector(20)
+		require.NoError(t, run(t, ct.consumer(col.handle, nil), col))
+		assert.ElementsMatch(t, resourceIDs, col.resourceIDs())
+
+		for _, msg := range col.messages {
+			assert.NotEmpty(t, msg.ShardID)
+			assert.NotEmpty(t, msg.SequenceNumber)
+			assert.NotEmpty(t, msg.PartitionKey)
+			assert.False(t, msg.ArrivedAt.IsZero())
+			assert.Equal(t, historyin.SchemaVersion, msg.SchemaVersion)
+			assert.Equal(t, historyin.Library, msg.Producer.Library)
+		}
+	})
+
+	t.Run("reads bare audits", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+
+		_, err := ct.srv.Kinesis().PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(streamName),
+			PartitionKey: aws.String("my-partition-key"),
+			Data:         []byte(`{"uuid": "uuid--uuid--uuid--uuid--uuid--uuid--", "action": "my-action", "resource_id": "a", "changes": null}`),
+		})
+		require.NoError(t, err)
+
+		col := newCollector(1)
+		require.NoError(t, run(t, ct.consumer(col.handle, nil), col))
+		require.Len(t, col.messages, 1)
+		assert.Equal(t, historyin.UUID("uuid--uuid--uuid--uuid--uuid--uuid--"), col.messages[0].Audit.UUID)
+		assert.Equal(t, 0, col.messages[0].SchemaVersion)
+		assert.Equal(t, historyin.Producer{}, col.messages[0].Producer)
+	})
+
+	t.Run("resumes from checkpoints", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+		checkpoints := new(MemoryCheckpointStore)
+
+		ct.add(t, "a", "b")
+		col := newCollector(2)
+		require.NoError(t, run(t, ct.consumer(col.handle, checkpoints), col))
+
+		ct.add(t, "c")
+		col = newCollector(1)
+		require.NoError(t, run(t, ct.consumer(col.handle, checkpoints), col))
+		assert.Equal(t, []string{"c"}, col.resourceIDs())
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+		checkpoints := new(MemoryCheckpointStore)
+
+		ct.add(t, "a", "b", "c")
+		col := newCollector(3)
+		col.fail = "b"
+		assert.EqualError(t, run(t, ct.consumer(col.handle, checkpoints), col), "my-error")
+		assert.Equal(t, []string{"a"}, col.resourceIDs())
+
+		col = newCollector(2)
+		require.NoError(t, run(t, ct.consumer(col.handle, checkpoints), col))
+		assert.Equal(t, []string{"b", "c"}, col.resourceIDs())
+	})
+
+	t.Run("de-aggregates", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+		checkpoints := new(MemoryCheckpointStore)
+
+		// audits are aggregated by partition key
+		ct.client.Aggregate = true
+		ct.client.PartitionKey = historyin.PartitionByUser
+		batcher, err := ct.client.BatcherWithOptions(historyin.BatcherOptions{FlushBatchSize: 10, FlushBatchAge: time.Hour})
+		require.NoError(t, err)
+		go batcher.Run()
+		defer batcher.Stop(time.Second)
+		for _, resourceID := range []string{"a", "b", "c"} {
+			require.NoError(t, batcher.Add(&historyin.Audit{
+				Action:       "my-action",
+				UserID:       "my-user-id",
+				ResourceType: "my-resource-type",
+				ResourceID:   resourceID,
+			}))
+		}
+		require.NoError(t, batcher.(historyin.Flusher).Flush(context.Background()))
+		require.Len(t, ct.srv.Records(streamName), 1)
+
+		col := newCollector(2)
+		col.fail = "c"
+		assert.Error(t, run(t, ct.consumer(col.handle, checkpoints), col))
+		assert.Equal(t, []string{"a", "b"}, col.resourceIDs())
+		assert.Equal(t, []int{0, 1}, []int{col.messages[0].SubSequenceNumber, col.messages[1].SubSequenceNumber})
+
+		col = newCollector(1)
+		require.NoError(t, run(t, ct.consumer(col.handle, checkpoints), col))
+		assert.Equal(t, []string{"c"}, col.resourceIDs())
+	})
+
+	t.Run("follows resharding", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+		ct.client.PartitionKey = historyin.PartitionByUser
+
+		ct.add(t, "0", "1", "2")
+		require.NoError(t, ct.srv.SplitShard(streamName, "shardId-000000000000"))
+		ct.add(t, "3", "4", "5")
+
+		col := newCollector(6)
+		require.NoError(t, run(t, ct.consumer(col.handle, nil), col))
+		assert.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, col.resourceIDs(),
+			"audits of a partition key should be in order")
+	})
+
+	t.Run("start at latest", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+		ct.add(t, "old")
+
+		col := newCollector(1)
+		consumer := ct.consumer(col.handle, nil)
+		consumer.StartAtLatest = true
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			ct.add(t, "new")
+		}()
+		require.NoError(t, run(t, consumer, col))
+		assert.Equal(t, []string{"new"}, col.resourceIDs())
+	})
+
+	t.Run("start at latest after iterator expires", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+		ct.add(t, "old")
+
+		col := newCollector(1)
+		consumer := ct.consumer(col.handle, nil)
+		consumer.StartAtLatest = true
+		consumer.Kinesis = &expiringKinesis{KinesisAPI: consumer.Kinesis, expire: 1}
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			ct.add(t, "new")
+		}()
+		require.NoError(t, run(t, consumer, col))
+		assert.Equal(t, []string{"new"}, col.resourceIDs())
+	})
+
+	t.Run("unknown stream", func(t *testing.T) {
+		ct := newConsumerTest(1)
+		defer ct.srv.Close()
+
+		consumer := ct.consumer(newCollector(1).handle, nil)
+		consumer.StreamName = "unknown"
+		assert.Error(t, consumer.Run(context.Background()))
+	})
+
+	t.Run("no handler", func(t *testing.T) {
+		assert.Equal(t, errNoHandler, new(Consumer).Run(context.Background()))
+	})
+}
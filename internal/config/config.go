@@ -5,34 +5,47 @@ import "fmt"
 // Config is the history stack configuration
 type Config struct {
 	StreamName string
+	// StreamType is StreamTypeKinesis or StreamTypeFirehose. Empty is kinesis.
+	StreamType string
 	AWSRegion  string
 	RoleARN    string
 }
 
+const (
+	// StreamTypeKinesis sends to a kinesis data stream
+	StreamTypeKinesis = "kinesis"
+	// StreamTypeFirehose sends to a kinesis data firehose delivery stream
+	StreamTypeFirehose = "firehose"
+)
+
 const (
 	defaultRegion = "us-west-2"
 )
 
 var (
 	stagingConfig = Config{
+		StreamType: StreamTypeKinesis,
 		AWSRegion:  defaultRegion,
 		RoleARN:    "arn:aws:iam::005087123760:role/history-v3-staging-ingest",
 		StreamName: "history-v3-staging-stream",
 	}
 
 	stagingCanaryConfig = Config{
+		StreamType: StreamTypeKinesis,
 		AWSRegion:  defaultRegion,
 		RoleARN:    "arn:aws:iam::005087123760:role/history-v3-staging-ingest",
 		StreamName: "history-v3-staging-stream",
 	}
 
 	prodConfig = Config{
+		StreamType: StreamTypeKinesis,
 		AWSRegion:  defaultRegion,
 		RoleARN:    "arn:aws:iam::958416494912:role/history-v3-prod-ingest",
 		StreamName: "history-v3-prod-stream",
 	}
 
 	prodCanaryConfig = Config{
+		StreamType: StreamTypeKinesis,
 		AWSRegion:  defaultRegion,
 		RoleARN:    "arn:aws:iam::958416494912:role/history-v3-prod-ingest",
 		StreamName: "history-v3-prod-stream",
@@ -0,0 +1,265 @@
+// Package kpl encodes and decodes records in the Kinesis Producer Library
+// aggregated record format so KCL consumers de-aggregate them transparently.
+//
+// An aggregated record is the magic bytes, followed by an AggregatedRecord
+// protobuf message, followed by the MD5 of the message:
+//
+//	message AggregatedRecord {
+//	  repeated string partition_key_table     = 1;
+//	  repeated string explicit_hash_key_table = 2;
+//	  repeated Record records                 = 3;
+//	}
+//
+//	message Record {
+//	  required uint64 partition_key_index     = 1;
+//	  optional uint64 explicit_hash_key_index = 2;
+//	  required bytes  data                    = 3;
+//	  repeated Tag    tags                    = 4;
+//	}
+package kpl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// protobuf field numbers
+const (
+	fieldPartitionKeyTable    = 1
+	fieldExplicitHashKeyTable = 2
+	fieldRecords              = 3
+
+	fieldPartitionKeyIndex    = 1
+	fieldExplicitHashKeyIndex = 2
+	fieldData                 = 3
+)
+
+// protobuf wire types
+const (
+	wireVarint          = 0
+	wireFixed64         = 1
+	wireLengthDelimited = 2
+	wireFixed32         = 5
+)
+
+var (
+	// Magic prefixes every aggregated record
+	Magic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+	errNotAggregated      = errors.New("kpl: record is not aggregated")
+	errChecksumMismatch   = errors.New("kpl: aggregated record checksum mismatch")
+	errMalformed          = errors.New("kpl: aggregated record malformed")
+	errIndexOutOfRange    = errors.New("kpl: aggregated record key index out of range")
+	errMissingRecordField = errors.New("kpl: aggregated record missing required field")
+)
+
+// Record is a user record packed in an aggregated record
+type Record struct {
+	PartitionKey string
+	// ExplicitHashKey is optional
+	ExplicitHashKey string
+	Data            []byte
+}
+
+// IsAggregated returns true if data is an aggregated record
+func IsAggregated(data []byte) bool {
+	return len(data) >= len(Magic)+md5.Size && bytes.Equal(data[:len(Magic)], Magic)
+}
+
+// Marshal packs records into an aggregated record
+func Marshal(records []*Record) []byte {
+	var partitionKeys, explicitHashKeys keyTable
+	var message []byte
+	for _, rec := range records {
+		var record []byte
+		record = appendVarintField(record, fieldPartitionKeyIndex, partitionKeys.index(rec.PartitionKey))
+		if rec.ExplicitHashKey != "" {
+			record = appendVarintField(record, fieldExplicitHashKeyIndex, explicitHashKeys.index(rec.ExplicitHashKey))
+		}
+		record = appendBytesField(record, fieldData, rec.Data)
+		message = appendBytesField(message, fieldRecords, record)
+	}
+
+	var header []byte
+	for _, key := range partitionKeys.keys {
+		header = appendBytesField(header, fieldPartitionKeyTable, []byte(key))
+	}
+	for _, key := range explicitHashKeys.keys {
+		header = appendBytesField(header, fieldExplicitHashKeyTable, []byte(key))
+	}
+	message = append(header, message...)
+
+	checksum := md5.Sum(message)
+	data := make([]byte, 0, len(Magic)+len(message)+md5.Size)
+	data = append(data, Magic...)
+	data = append(data, message...)
+	return append(data, checksum[:]...)
+}
+
+// Unmarshal unpacks the user records of an aggregated record
+func Unmarshal(data []byte) ([]*Record, error) {
+	if !IsAggregated(data) {
+		return nil, errNotAggregated
+	}
+
+	message := data[len(Magic) : len(data)-md5.Size]
+	checksum := md5.Sum(message)
+	if !bytes.Equal(checksum[:], data[len(data)-md5.Size:]) {
+		return nil, errChecksumMismatch
+	}
+
+	var partitionKeys, explicitHashKeys []string
+	var rawRecords [][]byte
+	err := readFields(message, func(field int, value []byte, _ uint64) error {
+		switch field {
+		case fieldPartitionKeyTable:
+			partitionKeys = append(partitionKeys, string(value))
+		case fieldExplicitHashKeyTable:
+			explicitHashKeys = append(explicitHashKeys, string(value))
+		case fieldRecords:
+			rawRecords = append(rawRecords, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*Record, 0, len(rawRecords))
+	for _, raw := range rawRecords {
+		var rec Record
+		var hasPartitionKey, hasData bool
+		err := readFields(raw, func(field int, value []byte, varint uint64) error {
+			switch field {
+			case fieldPartitionKeyIndex:
+				if varint >= uint64(len(partitionKeys)) {
+					return errIndexOutOfRange
+				}
+				rec.PartitionKey = partitionKeys[varint]
+				hasPartitionKey = true
+			case fieldExplicitHashKeyIndex:
+				if varint >= uint64(len(explicitHashKeys)) {
+					return errIndexOutOfRange
+				}
+				rec.ExplicitHashKey = explicitHashKeys[varint]
+			case fieldData:
+				rec.Data = value
+				hasData = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !hasPartitionKey || !hasData {
+			return nil, errMissingRecordField
+		}
+		records = append(records, &rec)
+	}
+
+	return records, nil
+}
+
+// Overhead is the most bytes an aggregated record of nRecords adds to the
+// data and keys of the records it packs
+func Overhead(nRecords int) int {
+	// magic and checksum, then per record the tag and length of the record, its
+	// data and its key table entries, and its key indexes
+	return len(Magic) + md5.Size + nRecords*6*(1+binary.MaxVarintLen32)
+}
+
+// ExplicitHashKey returns the hash key kinesis derives from a partition key,
+// the MD5 of the key as a 128 bit unsigned integer in decimal
+func ExplicitHashKey(partitionKey string) string {
+	sum := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(sum[:]).String()
+}
+
+// keyTable dedupes keys and assigns indexes in order of first use
+type keyTable struct {
+	keys    []string
+	indexes map[string]uint64
+}
+
+func (t *keyTable) index(key string) uint64 {
+	if t.indexes == nil {
+		t.indexes = make(map[string]uint64)
+	}
+
+	index, ok := t.indexes[key]
+	if !ok {
+		index = uint64(len(t.keys))
+		t.indexes[key] = index
+		t.keys = append(t.keys, key)
+	}
+	return index
+}
+
+func appendVarintField(buf []byte, field int, value uint64) []byte {
+	buf = appendVarint(buf, uint64(field<<3|wireVarint))
+	return appendVarint(buf, value)
+}
+
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = appendVarint(buf, uint64(field<<3|wireLengthDelimited))
+	buf = appendVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendVarint(buf []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], value)
+	return append(buf, scratch[:n]...)
+}
+
+// readFields calls fn with every field of a protobuf message. value is set for
+// length delimited fields and varint for varint fields. Other wire types are
+// skipped.
+func readFields(message []byte, fn func(field int, value []byte, varint uint64) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return errMalformed
+		}
+		message = message[n:]
+
+		field := int(key >> 3)
+		switch key & 0x7 {
+		case wireVarint:
+			varint, n := binary.Uvarint(message)
+			if n <= 0 {
+				return errMalformed
+			}
+			message = message[n:]
+			if err := fn(field, nil, varint); err != nil {
+				return err
+			}
+		case wireLengthDelimited:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return errMalformed
+			}
+			value := message[n : n+int(length)]
+			message = message[n+int(length):]
+			if err := fn(field, value, 0); err != nil {
+				return err
+			}
+		case wireFixed64:
+			if len(message) < 8 {
+				return errMalformed
+			}
+			message = message[8:]
+		case wireFixed32:
+			if len(message) < 4 {
+				return errMalformed
+			}
+			message = message[4:]
+		default:
+			return errMalformed
+		}
+	}
+	return nil
+}
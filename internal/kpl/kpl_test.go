@@ -0,0 +1,77 @@
+package kpl
+
+import (
+	"crypto/md5"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKPL(t *testing.T) {
+	records := []*Record{
+		{PartitionKey: "key-a", Data: []byte("one")},
+		{PartitionKey: "key-b", ExplicitHashKey: "1234", Data: []byte("two")},
+		{PartitionKey: "key-a", Data: []byte("three")},
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		data := Marshal(records)
+		assert.True(t, IsAggregated(data))
+
+		unmarshalled, err := Unmarshal(data)
+		require.NoError(t, err)
+		assert.Equal(t, records, unmarshalled)
+	})
+
+	t.Run("wire format", func(t *testing.T) {
+		data := Marshal(records[:1])
+		message := []byte{
+			// partition_key_table: "key-a"
+			0x0a, 0x05, 'k', 'e', 'y', '-', 'a',
+			// records: {partition_key_index: 0, data: "one"}
+			0x1a, 0x07, 0x08, 0x00, 0x1a, 0x03, 'o', 'n', 'e',
+		}
+		checksum := md5.Sum(message)
+
+		expected := append(append(append([]byte{}, Magic...), message...), checksum[:]...)
+		assert.Equal(t, expected, data)
+	})
+
+	t.Run("overhead", func(t *testing.T) {
+		data := Marshal(records)
+		var payload int
+		for _, rec := range records {
+			payload += len(rec.Data)
+		}
+		keyTables := len("key-a") + len("key-b") + len("1234") + 3*2
+		assert.True(t, len(data) <= payload+keyTables+Overhead(len(records)))
+	})
+
+	t.Run("not aggregated", func(t *testing.T) {
+		assert.False(t, IsAggregated([]byte(`{"uuid":"my-uuid"}`)))
+		_, err := Unmarshal([]byte(`{"uuid":"my-uuid"}`))
+		assert.Equal(t, errNotAggregated, err)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		data := Marshal(records)
+		data[len(Magic)] ^= 0xff
+		_, err := Unmarshal(data)
+		assert.Equal(t, errChecksumMismatch, err)
+	})
+
+	t.Run("index out of range", func(t *testing.T) {
+		message := []byte{0x1a, 0x07, 0x08, 0x01, 0x1a, 0x03, 'o', 'n', 'e'}
+		checksum := md5.Sum(message)
+		data := append(append(append([]byte{}, Magic...), message...), checksum[:]...)
+
+		_, err := Unmarshal(data)
+		assert.Equal(t, errIndexOutOfRange, err)
+	})
+
+	t.Run("ExplicitHashKey", func(t *testing.T) {
+		// md5("") = d41d8cd98f00b204e9800998ecf8427e
+		assert.Equal(t, "281949768489412648962353822266799178366", ExplicitHashKey(""))
+	})
+}